@@ -0,0 +1,279 @@
+package throttle
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// admit applies the accept limits to the accepted conn. It returns
+// the source of the conn if connections are grouped by sources and
+// whether the conn is admitted. Admitted conns must be released
+// with closeConn. Conns over the limits are rejected, or in delay
+// mode conns over the source limits are parked until the source
+// admits them (see park), so they do not delay other sources.
+func (l *Listener) admit(conn net.Conn) (*source, bool) {
+	var reject = l.Reject()
+	if reject && !l.ab.TryConsume(1) {
+		l.rejectConn(conn)
+		return nil, false
+	}
+
+	var src *source
+	if l.sourced() {
+		src = l.acquire(l.sourceKey(conn.RemoteAddr()))
+		if reject && !src.ab.TryConsume(1) {
+			l.release(src)
+			l.rejectConn(conn)
+			return nil, false
+		}
+	}
+
+	l.mu.Lock()
+
+	if src != nil && !reject {
+		// keep the order of the conns of the source
+		if len(src.pending) > 0 || l.sourceOverLimit(src) || !src.ab.TryConsume(1) {
+			l.park(conn, src)
+			l.mu.Unlock()
+			return nil, false
+		}
+	}
+
+	for l.overLimit(src) {
+		if reject || l.closed.Err() != nil {
+			if src != nil {
+				l.releaseLocked(src, l.rb.Clock().Now().UnixNano())
+			}
+			l.mu.Unlock()
+			if reject {
+				l.rejectConn(conn)
+			} else {
+				_ = conn.Close()
+			}
+			return nil, false
+		}
+		l.freed.Wait()
+	}
+
+	l.admitLocked(src)
+	l.mu.Unlock()
+	return src, true
+}
+
+// admitLocked accounts the admitted conn of the source.
+// It must be called under the lock.
+func (l *Listener) admitLocked(src *source) {
+	l.conns++
+	l.accepted++
+	if src != nil {
+		src.conns++
+	}
+}
+
+// park puts the conn over the source limits into the pending
+// conns of the source and starts admitting them unless it is
+// in progress already. It must be called under the lock.
+func (l *Listener) park(conn net.Conn, src *source) {
+	src.pending = append(src.pending, conn)
+	if len(src.pending) == 1 {
+		go l.drain(src)
+	}
+}
+
+// drain admits the pending conns of the source in the order
+// of arrival as the limits of the source allow and hands them
+// to Accept. It closes them when the listener is closed.
+func (l *Listener) drain(src *source) {
+	for {
+		// the accept rate of the source
+		if _, err := src.ab.ConsumeContext(l.closed, 1); err != nil {
+			l.dropPending(src)
+			return
+		}
+
+		l.mu.Lock()
+		for l.overLimit(src) {
+			if l.closed.Err() != nil {
+				l.mu.Unlock()
+				l.dropPending(src)
+				return
+			}
+			l.freed.Wait()
+		}
+
+		var conn = src.pending[0]
+		src.pending[0] = nil
+		src.pending = src.pending[1:]
+		var more = len(src.pending) > 0
+		l.admitLocked(src)
+		l.mu.Unlock()
+
+		l.handOff(conn, src)
+		if !more {
+			return
+		}
+	}
+}
+
+// dropPending closes the pending conns of the source.
+func (l *Listener) dropPending(src *source) {
+	var now = l.rb.Clock().Now().UnixNano()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, conn := range src.pending {
+		_ = conn.Close()
+		l.releaseLocked(src, now)
+	}
+	src.pending = nil
+}
+
+// waitConns waits until the number of live connections is
+// below the limit of the server class.
+func (l *Listener) waitConns() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.overLimit(nil) {
+		if l.closed.Err() != nil {
+			return net.ErrClosed
+		}
+		l.freed.Wait()
+	}
+	return nil
+}
+
+// overLimit reports whether the number of live connections of
+// the server class or of the source reached the limits. It must
+// be called under the lock.
+func (l *Listener) overLimit(src *source) bool {
+	if max := atomic.LoadInt64(&l.maxConns); max > 0 && int64(l.conns) >= max {
+		return true
+	}
+	return src != nil && l.sourceOverLimit(src)
+}
+
+// sourceOverLimit reports whether the number of live connections
+// of the source reached the limit. It must be called under the lock.
+func (l *Listener) sourceOverLimit(src *source) bool {
+	var max = atomic.LoadInt64(&l.srcMaxConns)
+	return max > 0 && int64(src.conns) >= max
+}
+
+// closeConn accounts the admitted conn is closed.
+func (l *Listener) closeConn(c *Conn, src *source) {
+	var now = l.rb.Clock().Now().UnixNano()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.registry, c)
+	l.closedStats.add(c.Stats())
+	l.conns--
+	if src != nil {
+		src.conns--
+		l.releaseLocked(src, now)
+	}
+	l.freed.Broadcast()
+}
+
+// rejectConn closes the conn over the limits.
+func (l *Listener) rejectConn(conn net.Conn) {
+	l.mu.Lock()
+	l.rejected++
+	var onReject = l.onReject
+	l.mu.Unlock()
+
+	if onReject == nil {
+		_ = conn.Close()
+		return
+	}
+	go func() {
+		onReject(conn)
+		_ = conn.Close()
+	}()
+}
+
+// ActiveConns returns the number of live connections
+// accepted by the listener.
+func (l *Listener) ActiveConns() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conns
+}
+
+// SetAcceptRate limits the rate of accepting connections to
+// perSec connections per second with bursts of up to burst
+// connections. The rate of 0 means no limit.
+func (l *Listener) SetAcceptRate(perSec, burst uint64) {
+	if burst == 0 {
+		burst = 1
+	}
+	l.ab.SetRate(perSec)
+	l.ab.SetBurst(burst)
+}
+
+// SetMaxConns limits the number of live connections. The limit
+// of 0 means no limit.
+func (l *Listener) SetMaxConns(n int) {
+	atomic.StoreInt64(&l.maxConns, int64(n))
+	l.mu.Lock()
+	l.freed.Broadcast()
+	l.mu.Unlock()
+}
+
+// SetSourceAcceptRate limits the rate of accepting connections
+// per source, see SetAcceptRate and SetSourcePrefix. It applies
+// to new sources. Sources are kept for the idle timeout after
+// their last connection is closed (see SetSourceIdleTimeout),
+// so the rate holds for reconnects within the timeout.
+func (l *Listener) SetSourceAcceptRate(perSec, burst uint64) {
+	if burst == 0 {
+		burst = 1
+	}
+	atomic.StoreUint64(&l.srcAcceptBurst, burst)
+	atomic.StoreUint64(&l.srcAccept, perSec)
+}
+
+// SetSourceMaxConns limits the number of live connections
+// per source, see SetSourcePrefix. The limit of 0 means
+// no limit.
+func (l *Listener) SetSourceMaxConns(n int) {
+	atomic.StoreInt64(&l.srcMaxConns, int64(n))
+	l.mu.Lock()
+	l.freed.Broadcast()
+	l.mu.Unlock()
+}
+
+// Reject reports whether connections over the accept limits
+// are rejected instead of delayed.
+func (l *Listener) Reject() bool {
+	return atomic.LoadUint32(&l.reject) == 1
+}
+
+// SetReject makes the listener close connections over the
+// accept limits right away instead of delaying them. By
+// default connections over the limits of the server class
+// are kept in the backlog until the limits allow them, and
+// connections over the source limits are kept open until
+// the source allows them, so they don't delay other sources.
+func (l *Listener) SetReject(reject bool) {
+	var v uint32
+	if reject {
+		v = 1
+	}
+	atomic.StoreUint32(&l.reject, v)
+}
+
+// SetOnReject sets the function called with a rejected
+// connection before it is closed, e.g. to write a rejection
+// message. It runs in a goroutine of its own, so a slow peer
+// does not stall accepting other connections. It should still
+// set a write deadline, as the connection is held open until
+// it returns.
+func (l *Listener) SetOnReject(onReject func(conn net.Conn)) {
+	l.mu.Lock()
+	l.onReject = onReject
+	l.mu.Unlock()
+}
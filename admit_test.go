@@ -0,0 +1,270 @@
+package throttle
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListener_Admit(t *testing.T) {
+	// listen returns the throttled listener on loopback
+	// and the channel of its accepted connections
+	listen := func(t *testing.T) (*Listener, <-chan net.Conn) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("net.Listen:", err)
+		}
+		wrap := WrapListener(ln)
+		accepted := make(chan net.Conn, 10)
+		go func() {
+			for {
+				conn, err := wrap.Accept()
+				if err != nil {
+					close(accepted)
+					return
+				}
+				accepted <- conn
+			}
+		}()
+		return wrap, accepted
+	}
+
+	dial := func(t *testing.T, l *Listener) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("net.Dial:", err)
+		}
+		return conn
+	}
+
+	// dialFrom dials the listener from the local loopback ip
+	dialFrom := func(t *testing.T, l *Listener, ip string) net.Conn {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		conn, err := d.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("net.Dial:", err)
+		}
+		return conn
+	}
+
+	// assertAccepted returns the next accepted conn
+	assertAccepted := func(t *testing.T, accepted <-chan net.Conn) net.Conn {
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(time.Second):
+			t.Fatal("connection is not accepted")
+		}
+		return nil
+	}
+
+	assertNotAccepted := func(t *testing.T, accepted <-chan net.Conn) {
+		select {
+		case <-accepted:
+			t.Fatal("connection is accepted")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	t.Run("rejects over max conns", func(t *testing.T) {
+		wrap, accepted := listen(t)
+		defer wrap.Close()
+		wrap.SetMaxConns(1)
+		wrap.SetReject(true)
+		wrap.SetOnReject(func(conn net.Conn) {
+			_, _ = conn.Write([]byte("busy"))
+		})
+
+		client1 := dial(t, wrap)
+		defer client1.Close()
+		conn1 := assertAccepted(t, accepted)
+		assertEqU64(t, uint64(wrap.ActiveConns()), 1)
+
+		client2 := dial(t, wrap)
+		defer client2.Close()
+		msg, err := ioutil.ReadAll(client2)
+		assertNoErr(t, err)
+		assertTrue(t, string(msg) == "busy", string(msg))
+		assertNotAccepted(t, accepted)
+
+		assertNoErr(t, conn1.Close())
+		assertEqU64(t, uint64(wrap.ActiveConns()), 0)
+
+		client3 := dial(t, wrap)
+		defer client3.Close()
+		assertNoErr(t, assertAccepted(t, accepted).Close())
+	})
+
+	t.Run("slow reject does not stall accepting", func(t *testing.T) {
+		wrap, accepted := listen(t)
+		defer wrap.Close()
+		wrap.SetMaxConns(1)
+		wrap.SetReject(true)
+		release := make(chan struct{})
+		rejected := make(chan struct{})
+		wrap.SetOnReject(func(conn net.Conn) {
+			close(rejected)
+			<-release
+		})
+		defer close(release)
+
+		client1 := dial(t, wrap)
+		defer client1.Close()
+		conn1 := assertAccepted(t, accepted)
+
+		client2 := dial(t, wrap)
+		defer client2.Close()
+		<-rejected
+
+		assertNoErr(t, conn1.Close())
+		client3 := dial(t, wrap)
+		defer client3.Close()
+		assertNoErr(t, assertAccepted(t, accepted).Close())
+	})
+
+	t.Run("delays over max conns", func(t *testing.T) {
+		wrap, accepted := listen(t)
+		defer wrap.Close()
+		wrap.SetMaxConns(1)
+
+		client1 := dial(t, wrap)
+		defer client1.Close()
+		conn1 := assertAccepted(t, accepted)
+
+		client2 := dial(t, wrap)
+		defer client2.Close()
+		assertNotAccepted(t, accepted)
+
+		assertNoErr(t, conn1.Close())
+		assertNoErr(t, assertAccepted(t, accepted).Close())
+	})
+
+	t.Run("rejects over source max conns", func(t *testing.T) {
+		wrap, accepted := listen(t)
+		defer wrap.Close()
+		wrap.SetSourceMaxConns(1)
+		wrap.SetReject(true)
+
+		client1 := dial(t, wrap)
+		defer client1.Close()
+		conn1 := assertAccepted(t, accepted)
+		defer conn1.Close()
+		assertEqU64(t, uint64(wrap.Sources()), 1)
+
+		client2 := dial(t, wrap)
+		defer client2.Close()
+		_, err := ioutil.ReadAll(client2)
+		assertNoErr(t, err)
+		assertNotAccepted(t, accepted)
+		assertEqU64(t, uint64(wrap.ActiveConns()), 1)
+	})
+
+	t.Run("source over accept rate does not delay others", func(t *testing.T) {
+		wrap, accepted := listen(t)
+		defer wrap.Close()
+		wrap.SetSourceAcceptRate(1, 1)
+
+		client1 := dialFrom(t, wrap, "127.0.0.2")
+		defer client1.Close()
+		conn1 := assertAccepted(t, accepted)
+		defer conn1.Close()
+
+		client2 := dialFrom(t, wrap, "127.0.0.2")
+		defer client2.Close()
+		assertNotAccepted(t, accepted)
+
+		start := time.Now()
+		client3 := dialFrom(t, wrap, "127.0.0.3")
+		defer client3.Close()
+		conn3 := assertAccepted(t, accepted)
+		defer conn3.Close()
+		assertTrue(t, conn3.RemoteAddr().String() == client3.LocalAddr().String(), conn3.RemoteAddr())
+		assertTrue(t, time.Since(start) < 500*time.Millisecond, "accepted in", time.Since(start))
+
+		// the delayed conn of the source comes at its rate
+		conn2 := assertAccepted(t, accepted)
+		defer conn2.Close()
+		assertTrue(t, conn2.RemoteAddr().String() == client2.LocalAddr().String(), conn2.RemoteAddr())
+	})
+
+	t.Run("source over max conns does not delay others", func(t *testing.T) {
+		wrap, accepted := listen(t)
+		defer wrap.Close()
+		wrap.SetSourceMaxConns(1)
+
+		client1 := dialFrom(t, wrap, "127.0.0.2")
+		defer client1.Close()
+		conn1 := assertAccepted(t, accepted)
+
+		client2 := dialFrom(t, wrap, "127.0.0.2")
+		defer client2.Close()
+		client3 := dialFrom(t, wrap, "127.0.0.3")
+		defer client3.Close()
+		conn3 := assertAccepted(t, accepted)
+		defer conn3.Close()
+		assertTrue(t, conn3.RemoteAddr().String() == client3.LocalAddr().String(), conn3.RemoteAddr())
+		assertNotAccepted(t, accepted)
+		assertEqU64(t, uint64(wrap.ActiveConns()), 2)
+
+		assertNoErr(t, conn1.Close())
+		conn2 := assertAccepted(t, accepted)
+		defer conn2.Close()
+		assertTrue(t, conn2.RemoteAddr().String() == client2.LocalAddr().String(), conn2.RemoteAddr())
+	})
+
+	t.Run("close drops pending conns", func(t *testing.T) {
+		wrap, accepted := listen(t)
+		wrap.SetSourceMaxConns(1)
+
+		client1 := dial(t, wrap)
+		defer client1.Close()
+		conn1 := assertAccepted(t, accepted)
+		defer conn1.Close()
+
+		client2 := dial(t, wrap)
+		defer client2.Close()
+		assertNotAccepted(t, accepted)
+
+		assertNoErr(t, wrap.Close())
+		_, err := ioutil.ReadAll(client2)
+		assertNoErr(t, err)
+	})
+
+	t.Run("rejects over accept rate", func(t *testing.T) {
+		wrap, accepted := listen(t)
+		defer wrap.Close()
+		wrap.SetAcceptRate(1, 2)
+		wrap.SetReject(true)
+
+		for i := 0; i < 2; i++ {
+			client := dial(t, wrap)
+			defer client.Close()
+			assertNoErr(t, assertAccepted(t, accepted).Close())
+		}
+
+		client := dial(t, wrap)
+		defer client.Close()
+		_, err := ioutil.ReadAll(client)
+		assertNoErr(t, err)
+		assertNotAccepted(t, accepted)
+	})
+
+	t.Run("close wakes delayed accept", func(t *testing.T) {
+		wrap, accepted := listen(t)
+		wrap.SetMaxConns(1)
+
+		client := dial(t, wrap)
+		defer client.Close()
+		conn := assertAccepted(t, accepted)
+		defer conn.Close()
+
+		assertNoErr(t, wrap.Close())
+		select {
+		case _, ok := <-accepted:
+			assertTrue(t, !ok, "accepted after close")
+		case <-time.After(time.Second):
+			t.Fatal("accept is still waiting after close")
+		}
+	})
+}
@@ -1,129 +1,389 @@
 package throttle
 
 import (
+	"context"
+	"math"
+	"math/bits"
 	"sync/atomic"
 	"time"
 )
 
-// Bucket is a variant of a token bucket in which
-// bucket size does not exceed output speed.
-// (R = capacity/sec, B = R * 1 sec = capacity).
+// Bucket is a variant of a token bucket in which tokens
+// are generated at rate R per second and at most B of them
+// can be consumed at once (burst). By default bucket size
+// does not exceed output speed (B = R * 1 sec = capacity).
+// The bucket is unlimited when R = 0.
+//
+// R is kept as a fraction of tokens per period, so rates below
+// 1 token/sec are possible. Tokens are generated with ns
+// precision and a fraction of a token is carried over to
+// the next update.
 type Bucket struct {
 	fill     uint64
-	capacity uint64
+	capacity uint64 // burst
+	rate     uint64 // tokens per period
+	per      uint64 // period in ns, 0 means 1 sec
 
+	// time up to which tokens are generated (ns)
 	ts uint64
+
+	// strict FIFO order of blocked consumers
+	fifo  uint32
+	queue waitQueue
+
+	// parent bucket in a tree of buckets
+	parent *Bucket
+
+	// sum of weights of hierarchies consuming at the bucket
+	// and the limits of the scheduling unit divisor for them
+	active uint64
+	minDiv uint64
+	maxDiv uint64
+
+	clock Clock
+
+	stats counters
 }
 
 var _ Throttle = (*Bucket)(nil)
 var _ Capacity = (*Bucket)(nil)
 
 func NewBucket(capacity uint64) *Bucket {
+	return NewBucketRateBurst(capacity, capacity)
+}
+
+// NewBucketRateBurst returns a bucket which generates rate
+// tokens per second and allows to consume burst tokens at once.
+// A limited bucket needs a positive burst.
+func NewBucketRateBurst(rate, burst uint64) *Bucket {
+	return NewBucketRatePer(rate, time.Second, burst)
+}
+
+// NewBucketRatePer returns a bucket which generates tokens
+// per period and allows to consume burst tokens at once.
+func NewBucketRatePer(tokens uint64, per time.Duration, burst uint64) *Bucket {
 	return &Bucket{
 		fill:     0,
-		capacity: capacity,
+		capacity: burst,
+		rate:     tokens,
+		per:      uint64(per),
 		ts:       0,
 	}
 }
 
+// NewBucketEvery returns a bucket which generates a token
+// every interval and allows to consume burst tokens at once.
+func NewBucketEvery(interval time.Duration, burst uint64) *Bucket {
+	return NewBucketRatePer(1, interval, burst)
+}
+
 // Consume consumes bucket tokens if there is enough of them
 // in a thread safe manner. If there are not enough tokens
 // it blocks waiting for the maximum capacity. Consume returns
-// a capacity at most at once.
+// a capacity (burst) at most at once.
 //
 // It is implemented with atomics because I wanted to play with
 // lock free bucket, not because it is faster for a single
 // consumer.
 func (b *Bucket) Consume(consume uint64) uint64 {
-	var capacity = atomic.LoadUint64(&b.capacity)
+	consume, _ = b.ConsumeContext(context.Background(), consume)
+	return consume
+}
+
+// ConsumeContext is Consume which gives up waiting for the tokens
+// when ctx is done. With the system clock it also gives up at once
+// if the tokens would not come before the ctx deadline. Other clocks
+// always wait, as the deadline is in the wall time and not in theirs.
+// In both cases it returns 0 and an error of ctx.
+func (b *Bucket) ConsumeContext(ctx context.Context, consume uint64) (uint64, error) {
+	consume, _, err := b.consume(ctx, consume, 0)
+	return consume, err
+}
+
+// consume is ConsumeContext of a consumer with the priority
+// in the FIFO queue. It also returns the time it has waited.
+func (b *Bucket) consume(ctx context.Context, consume uint64, priority int) (uint64, time.Duration, error) {
+	var capacity, rate = b.limits()
 	var consumed bool
 	var fill uint64
 
-	if capacity == 0 {
-		return consume
+	if err := ctx.Err(); err != nil {
+		atomic.AddUint64(&b.stats.refused, consume)
+		return 0, 0, err
+	}
+
+	if rate.unlimited() {
+		atomic.AddUint64(&b.stats.consumed, consume)
+		return consume, 0, nil
 	}
 
 	if consume > capacity {
 		consume = capacity
 	}
 
+	// waiting in the queue and for the tokens
+	var clock = b.Clock()
+	var start = clock.Now()
+	var blocked bool
+
+	// priorities are served by the queue only
+	if b.FIFO() {
+		queued, err := b.queue.acquire(ctx, priority, start)
+		blocked = queued
+		if err != nil {
+			atomic.AddUint64(&b.stats.refused, consume)
+			return 0, b.stats.wait(blocked, start, clock), err
+		}
+		defer func() {
+			b.queue.release(clock.Now())
+		}()
+	}
+
 	for !consumed {
-		// update last update point
-		var prev = atomic.LoadUint64(&b.ts)
-		// fix time not to drop last piece of update
-		var now = (uint64(time.Now().UnixNano()) / uint64(time.Millisecond)) * uint64(time.Millisecond)
-		if !atomic.CompareAndSwapUint64(&b.ts, prev, now) {
+		if !b.refill(rate) {
 			continue
 		}
 
-		// generate tokens past last timestamp
-		if now-prev >= uint64(time.Second) {
-			// forgive possible race condition
-			atomic.StoreUint64(&b.fill, 0)
-			fill = 0
-		} else {
-			var deltaMS = (now - prev) / uint64(time.Millisecond)
-			var tokens = capacity * deltaMS / 1000
-			if tokens > 0 {
-				for {
-					fill = atomic.LoadUint64(&b.fill)
-					if tokens >= fill {
-						// forgive possible race condition
-						atomic.StoreUint64(&b.fill, 0)
-						fill = 0
-						break
-					} else if atomic.CompareAndSwapUint64(&b.fill, fill, fill-tokens) {
-						fill -= tokens
-						break
+		fill, consumed = b.take(capacity, consume)
+
+		// wait if there are no enough tokens
+		if !consumed {
+			// fill may exceed capacity because of reservations
+			if fill+consume > capacity {
+				var at = atomic.LoadUint64(&b.ts) + rate.duration(fill+consume-capacity)
+				var now = b.now()
+				if at > now {
+					blocked = true
+					if err := sleepContext(ctx, clock, time.Duration(at-now)); err != nil {
+						atomic.AddUint64(&b.stats.refused, consume)
+						return 0, b.stats.wait(blocked, start, clock), err
 					}
 				}
 			}
 		}
+	}
 
-		// lock-free consume tokens
-		for {
-			fill = atomic.LoadUint64(&b.fill)
+	atomic.AddUint64(&b.stats.consumed, consume)
+	return consume, b.stats.wait(blocked, start, clock), nil
+}
 
-			if fill+consume <= capacity {
-				consumed = atomic.CompareAndSwapUint64(&b.fill, fill, fill+consume)
-				if !consumed {
-					continue
-				}
-				fill += consume
-			}
+// TryConsume consumes exactly consume tokens if there is enough
+// of them right now. It never blocks. It reports whether the tokens
+// were consumed.
+func (b *Bucket) TryConsume(consume uint64) bool {
+	var capacity, rate = b.limits()
+	if rate.unlimited() {
+		atomic.AddUint64(&b.stats.consumed, consume)
+		return true
+	}
+	if consume > capacity {
+		atomic.AddUint64(&b.stats.refused, consume)
+		return false
+	}
+
+	for !b.refill(rate) {
+	}
 
+	if _, consumed := b.take(capacity, consume); !consumed {
+		atomic.AddUint64(&b.stats.refused, consume)
+		return false
+	}
+	atomic.AddUint64(&b.stats.consumed, consume)
+	return true
+}
+
+// TryConsumeUpTo consumes as much tokens as available right now
+// but no more than consume. It never blocks. It returns
+// the number of tokens consumed.
+func (b *Bucket) TryConsumeUpTo(consume uint64) uint64 {
+	var capacity, rate = b.limits()
+	if rate.unlimited() {
+		atomic.AddUint64(&b.stats.consumed, consume)
+		return consume
+	}
+
+	for !b.refill(rate) {
+	}
+
+	for {
+		var fill = atomic.LoadUint64(&b.fill)
+		var free uint64
+		if fill < capacity {
+			free = capacity - fill
+		}
+		if free > consume {
+			free = consume
+		}
+		if free == 0 || atomic.CompareAndSwapUint64(&b.fill, fill, fill+free) {
+			atomic.AddUint64(&b.stats.consumed, free)
+			atomic.AddUint64(&b.stats.refused, consume-free)
+			return free
+		}
+	}
+}
+
+// Reserve takes consume tokens from the bucket in advance and
+// returns a reservation which tells when the tokens are available.
+// The bucket goes into debt for the tokens which are not available
+// yet, so consumers coming later wait for them to be generated.
+// The reservation is not OK if consume exceeds the capacity.
+func (b *Bucket) Reserve(consume uint64) *Reservation {
+	var r = &Reservation{clock: b.Clock(), tokens: consume}
+	var capacity, rate = b.limits()
+
+	if rate.unlimited() {
+		atomic.AddUint64(&b.stats.consumed, consume)
+		r.ok = true
+		r.at = r.clock.Now()
+		return r
+	}
+	if consume > capacity {
+		atomic.AddUint64(&b.stats.refused, consume)
+		return r
+	}
+
+	r.ok = true
+	r.at = b.reserve(capacity, rate, consume)
+	r.buckets = []*Bucket{b}
+	return r
+}
+
+// reserve unconditionally takes tokens from the bucket and
+// returns the time they are available at.
+func (b *Bucket) reserve(capacity uint64, rate tokenRate, tokens uint64) time.Time {
+	for !b.refill(rate) {
+	}
+
+	atomic.AddUint64(&b.stats.consumed, tokens)
+	var fill = atomic.AddUint64(&b.fill, tokens)
+	var at = atomic.LoadUint64(&b.ts)
+	if fill > capacity {
+		at += rate.duration(fill - capacity)
+	}
+	return time.Unix(0, int64(at))
+}
+
+// refill generates tokens past last timestamp. It returns false
+// if it has lost the race for the timestamp update to another
+// consumer and must be retried.
+func (b *Bucket) refill(rate tokenRate) bool {
+	var prev = atomic.LoadUint64(&b.ts)
+	var now = b.now()
+	if now <= prev {
+		return true
+	}
+
+	var tokens = rate.tokens(now - prev)
+	if tokens == 0 {
+		// carry the fraction of a token
+		return true
+	}
+
+	// update last update point. move it only by the time
+	// the whole tokens took not to drop the fraction of
+	// the next token, unless the bucket drains completely.
+	var next = prev + mulDiv(tokens, rate.per, rate.n, false)
+	if next > now || tokens >= atomic.LoadUint64(&b.fill) {
+		next = now
+	}
+	if !atomic.CompareAndSwapUint64(&b.ts, prev, next) {
+		return false
+	}
+
+	for {
+		var fill = atomic.LoadUint64(&b.fill)
+		if tokens >= fill {
+			// forgive possible race condition
+			atomic.StoreUint64(&b.fill, 0)
+			break
+		} else if atomic.CompareAndSwapUint64(&b.fill, fill, fill-tokens) {
 			break
 		}
+	}
 
-		// wait if there are no enough tokens
-		if !consumed {
-			var free uint64
-			if capacity >= fill {
-				free = capacity - fill
-			}
-			if free < consume {
-				var wait = 1000 * (consume - free) / capacity
-				if wait < 1 {
-					wait = 1
-				}
-				time.Sleep(time.Millisecond * time.Duration(wait))
-			}
+	return true
+}
+
+// take lock-free consumes tokens if they fit into capacity.
+// It returns the fill of the bucket it has seen last.
+func (b *Bucket) take(capacity, consume uint64) (uint64, bool) {
+	for {
+		var fill = atomic.LoadUint64(&b.fill)
+		if fill+consume > capacity {
+			return fill, false
+		}
+		if atomic.CompareAndSwapUint64(&b.fill, fill, fill+consume) {
+			return fill + consume, true
 		}
 	}
+}
 
-	return consume
+// Refund gives back tokens consumed before but not used,
+// e.g. when a read returned less than it has consumed for
+// or upper levels of the hierarchy failed to provide theirs.
+func (b *Bucket) Refund(tokens uint64) {
+	atomic.AddUint64(&b.stats.refunded, tokens)
+	for {
+		var fill = atomic.LoadUint64(&b.fill)
+		var next uint64
+		if fill > tokens {
+			next = fill - tokens
+		}
+		if atomic.CompareAndSwapUint64(&b.fill, fill, next) {
+			return
+		}
+	}
+}
+
+// sleepContext sleeps for d or until ctx is done. It does not
+// sleep at all if ctx deadline comes before d passes. Deadlines
+// are in the wall time, so other clocks always sleep.
+func sleepContext(ctx context.Context, clock Clock, d time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok && clock == SystemClock && time.Until(deadline) < d {
+		return context.DeadlineExceeded
+	}
+
+	var t = clock.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (b *Bucket) Fill() uint64 {
 	return atomic.LoadUint64(&b.fill)
 }
 
+// Capacity returns the maximum number of tokens
+// that can be consumed at once (burst).
 func (b *Bucket) Capacity() uint64 {
 	return atomic.LoadUint64(&b.capacity)
 }
 
+// Burst is an alias of Capacity.
+func (b *Bucket) Burst() uint64 {
+	return b.Capacity()
+}
+
+// Rate returns the number of tokens generated per second.
+// It is truncated for fractional rates, see RatePer.
+func (b *Bucket) Rate() uint64 {
+	_, rate := b.limits()
+	return rate.tokens(uint64(time.Second))
+}
+
+// RatePer returns the number of tokens generated per period.
+func (b *Bucket) RatePer() (uint64, time.Duration) {
+	_, rate := b.limits()
+	return rate.n, time.Duration(rate.per)
+}
+
 func (b *Bucket) Unlimited() bool {
-	return atomic.LoadUint64(&b.capacity) == 0
+	return atomic.LoadUint64(&b.rate) == 0
 }
 
 func (b *Bucket) Available() uint64 {
@@ -135,22 +395,191 @@ func (b *Bucket) Available() uint64 {
 	return c - f
 }
 
+// SetCapacity sets both the rate and the burst to capacity.
 func (b *Bucket) SetCapacity(capacity uint64) {
 	atomic.StoreUint64(&b.capacity, capacity)
-	if capacity == 0 {
+	b.SetRate(capacity)
+}
+
+// SetRate sets the number of tokens generated per second.
+// The rate of 0 makes the bucket unlimited.
+func (b *Bucket) SetRate(rate uint64) {
+	b.SetRatePer(rate, time.Second)
+}
+
+// SetRatePer sets the number of tokens generated per period.
+func (b *Bucket) SetRatePer(tokens uint64, per time.Duration) {
+	atomic.StoreUint64(&b.per, uint64(per))
+	atomic.StoreUint64(&b.rate, tokens)
+	if tokens == 0 {
 		atomic.StoreUint64(&b.fill, 0)
 	}
 }
 
+// SetBurst sets the maximum number of tokens
+// that can be consumed at once.
+func (b *Bucket) SetBurst(burst uint64) {
+	atomic.StoreUint64(&b.capacity, burst)
+}
+
 func (b *Bucket) SetFill(fill uint64) {
 	atomic.StoreUint64(&b.fill, fill)
-	atomic.StoreUint64(&b.ts, (uint64(time.Now().UnixNano())/uint64(time.Millisecond))*uint64(time.Millisecond))
+	atomic.StoreUint64(&b.ts, b.now())
 }
 
 func (b *Bucket) Reset() {
 	b.SetFill(0)
 }
 
+// FIFO reports whether blocked consumers are served
+// in the order of arrival.
+func (b *Bucket) FIFO() bool {
+	return atomic.LoadUint32(&b.fifo) != 0
+}
+
+// SetFIFO makes blocked consumers of Consume and ConsumeContext
+// queue up and get the tokens strictly in the order of arrival,
+// instead of each of them polling the bucket on its own.
+// Hierarchies with a higher priority are served before the others
+// (see Hierarchy.SetPriority), and in the order of arrival within
+// the same priority. Non-blocking TryConsume and Reserve do not queue.
+func (b *Bucket) SetFIFO(fifo bool) {
+	var v uint32
+	if fifo {
+		v = 1
+	}
+	atomic.StoreUint32(&b.fifo, v)
+}
+
+// SetAging makes waiting consumers in FIFO mode raise their
+// priority by 1 for each aging period they wait, so consumers
+// of low priority can't starve forever. The aging of 0 disables it.
+func (b *Bucket) SetAging(aging time.Duration) {
+	b.queue.setAging(aging)
+}
+
+// Waiting returns the number of consumers queued
+// for the tokens in FIFO mode.
+func (b *Bucket) Waiting() int {
+	return b.queue.len()
+}
+
+// Parent returns the parent of the bucket in a tree of buckets.
+func (b *Bucket) Parent() *Bucket {
+	return b.parent
+}
+
+// SetParent attaches the bucket to a parent in a tree of buckets.
+// Hierarchies rooted at the bucket consume at the parent too.
+// It must be set before the bucket is used.
+func (b *Bucket) SetParent(parent *Bucket) {
+	for p := parent; p != nil; p = p.parent {
+		if p == b {
+			panic("throttle: bucket is an ancestor of its parent")
+		}
+	}
+	b.parent = parent
+}
+
+// Active returns the sum of weights of hierarchies
+// consuming at the bucket as an ancestor right now.
+func (b *Bucket) Active() uint64 {
+	return atomic.LoadUint64(&b.active)
+}
+
+// UnitDivisor returns the limits of the divisor of the capacity
+// used to size scheduling units of hierarchies, see SetUnitDivisor.
+func (b *Bucket) UnitDivisor() (min, max uint64) {
+	min = atomic.LoadUint64(&b.minDiv)
+	if min == 0 {
+		min = 16
+	}
+	return min, atomic.LoadUint64(&b.maxDiv)
+}
+
+// SetUnitDivisor limits the number of scheduling units the capacity
+// is split into for the active hierarchies. Each active hierarchy
+// gets capacity / active (by weight) at once, but no more than
+// capacity / min per unit of its weight and no less than
+// capacity / max. The max of 0
+// means no limit. It is (16, 0) by default, so that a leaf waiting
+// alone does not take the whole capacity from the ones to come.
+func (b *Bucket) SetUnitDivisor(min, max uint64) {
+	atomic.StoreUint64(&b.minDiv, min)
+	atomic.StoreUint64(&b.maxDiv, max)
+}
+
+// Timestamp returns the time up to which the tokens
+// have been generated, in ns.
 func (b *Bucket) Timestamp() uint64 {
 	return atomic.LoadUint64(&b.ts)
 }
+
+// Clock returns the source of time of the bucket.
+func (b *Bucket) Clock() Clock {
+	if b.clock == nil {
+		return SystemClock
+	}
+	return b.clock
+}
+
+// SetClock replaces the source of time of the bucket.
+// It must be set before the bucket is used.
+func (b *Bucket) SetClock(clock Clock) {
+	b.clock = clock
+}
+
+// limits returns the burst and the rate of the bucket.
+// forgive race condition for concurrent sets.
+func (b *Bucket) limits() (uint64, tokenRate) {
+	var rate = tokenRate{
+		n:   atomic.LoadUint64(&b.rate),
+		per: atomic.LoadUint64(&b.per),
+	}
+	if rate.per == 0 {
+		rate.per = uint64(time.Second)
+	}
+	return atomic.LoadUint64(&b.capacity), rate
+}
+
+// now returns current time in ns.
+func (b *Bucket) now() uint64 {
+	return uint64(b.Clock().Now().UnixNano())
+}
+
+// tokenRate is n tokens per period of ns.
+type tokenRate struct {
+	n   uint64
+	per uint64
+}
+
+func (r tokenRate) unlimited() bool {
+	return r.n == 0
+}
+
+// tokens returns the number of whole tokens generated in d ns.
+func (r tokenRate) tokens(d uint64) uint64 {
+	return mulDiv(d, r.n, r.per, false)
+}
+
+// duration returns ns it takes to generate tokens.
+func (r tokenRate) duration(tokens uint64) uint64 {
+	return mulDiv(tokens, r.per, r.n, true)
+}
+
+// mulDiv returns a * b / c rounded down or up,
+// saturating on overflow.
+func mulDiv(a, b, c uint64, up bool) uint64 {
+	var hi, lo = bits.Mul64(a, b)
+	if hi >= c {
+		return math.MaxUint64
+	}
+	var q, rem = bits.Div64(hi, lo, c)
+	if up && rem > 0 {
+		if q == math.MaxUint64 {
+			return q
+		}
+		q++
+	}
+	return q
+}
@@ -0,0 +1,306 @@
+package throttle_test
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sitano/throttle"
+	"github.com/sitano/throttle/throttletest"
+)
+
+func TestBucket_Consume(t *testing.T) {
+	newBucket := func(capacity uint64) (*throttle.Bucket, *throttletest.Clock) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(capacity)
+		b.SetClock(c)
+		return b, c
+	}
+
+	t.Run("returns immediately for unlimited bucket", func(t *testing.T) {
+		b := throttle.NewBucket(0)
+		assertEqU64(t, b.Consume(0), 0)
+		assertEqU64(t, b.Consume(1), 1)
+		assertEqU64(t, b.Consume(100), 100)
+		assertEqU64(t, b.Capacity(), 0)
+		assertEqU64(t, b.Fill(), 0)
+		assertEqU64(t, b.Timestamp(), 0)
+	})
+
+	t.Run("generates 1 token evenly", func(t *testing.T) {
+		b, c := newBucket(1)
+		assertConsumeIn(t, c, b, 1, 1, 0)
+		assertConsumeIn(t, c, b, 1, 1, time.Second)
+	})
+
+	t.Run("does not allow over feeding", func(t *testing.T) {
+		b, c := newBucket(1)
+		assertEqU64(t, b.Consume(2), 1)
+		assertConsumeIn(t, c, b, 2, 1, time.Second)
+	})
+
+	t.Run("capacity at once", func(t *testing.T) {
+		b, c := newBucket(10)
+
+		assertConsumeIn(t, c, b, 100, 10, 0, "consume all tokens first")
+		assertEqU64(t, b.Fill(), b.Capacity())
+
+		assertConsumeIn(t, c, b, 100, 10, time.Second)
+		assertEqU64(t, b.Fill(), b.Capacity())
+	})
+
+	t.Run("artificial timeout generates tokens", func(t *testing.T) {
+		b, c := newBucket(10)
+
+		assertConsumeIn(t, c, b, 100, 10, 0, "consume all tokens first")
+		assertEqU64(t, b.Fill(), b.Capacity())
+
+		assertConsumeIn(t, c, b, 1, 1, 100*time.Millisecond)
+		assertEqU64(t, b.Fill(), b.Capacity())
+
+		c.Advance(100 * time.Millisecond)
+		assertConsumeIn(t, c, b, 1, 1, 0)
+		assertEqU64(t, b.Fill(), b.Capacity())
+
+		c.Advance(200 * time.Millisecond)
+		assertConsumeIn(t, c, b, 1, 1, 0)
+		assertEqU64(t, b.Fill(), b.Capacity()-1)
+
+		assertConsumeIn(t, c, b, 1, 1, 0)
+		assertEqU64(t, b.Fill(), b.Capacity())
+	})
+
+	t.Run("all twice", func(t *testing.T) {
+		b, c := newBucket(1000)
+
+		assertConsumeIn(t, c, b, 2000, 1000, 0, "consume all tokens first")
+		assertEqU64(t, b.Fill(), b.Capacity())
+		assertConsumeIn(t, c, b, 2000, 1000, time.Second)
+		assertEqU64(t, b.Fill(), b.Capacity())
+	})
+
+	t.Run("flat/5s", func(t *testing.T) {
+		const window = 5 * time.Second
+		const bandwidth = 1000 // bytes / sec
+
+		b, c := newBucket(bandwidth)
+		assertConsumeIn(t, c, b, 2*bandwidth, bandwidth, 0, "consume all tokens first")
+
+		consumed := uint64(0)
+		start := c.Now()
+		for c.Now().Sub(start) < window {
+			assertConsumeIn(t, c, b, 10, 10, 10*time.Millisecond)
+			consumed += 10
+		}
+
+		assertAccuracy(t, consumed, bandwidth, c.Now().Sub(start))
+	})
+
+	t.Run("rnd/5s", func(t *testing.T) {
+		const window = 5 * time.Second
+		const bandwidth = 1000 // bytes / sec
+
+		b, c := newBucket(bandwidth)
+		assertConsumeIn(t, c, b, 2*bandwidth, bandwidth, 0, "consume all tokens first")
+
+		consumed := uint64(0)
+		start := c.Now()
+		for c.Now().Sub(start) < window {
+			dc, _ := consumeClock(c, b, uint64(rand.Intn(2*bandwidth)))
+			if dc < 1 {
+				t.Error("invalid consume")
+			}
+			consumed += dc
+		}
+
+		assertAccuracy(t, consumed, bandwidth, c.Now().Sub(start))
+	})
+}
+
+// consumeClock consumes at the bucket and moves the clock forward
+// by 1 ms while the consumer sleeps. It returns the tokens consumed
+// and the time it took by the clock.
+func consumeClock(c *throttletest.Clock, b *throttle.Bucket, consume uint64) (uint64, time.Duration) {
+	var start = c.Now()
+	var done = make(chan uint64, 1)
+	go func() {
+		done <- b.Consume(consume)
+	}()
+
+	for {
+		select {
+		case consumed := <-done:
+			return consumed, c.Now().Sub(start)
+		default:
+		}
+		if c.Timers() > 0 {
+			c.Advance(time.Millisecond)
+		} else {
+			runtime.Gosched()
+		}
+	}
+}
+
+func assertConsumeIn(t *testing.T, c *throttletest.Clock, b *throttle.Bucket, consume, expected uint64, in time.Duration, msg ...interface{}) {
+	consumed, took := consumeClock(c, b, consume)
+	if consumed != expected {
+		t.Error(append([]interface{}{"assert consume: ", consumed, "!=", expected}, msg...)...)
+	}
+	if took != in {
+		t.Error(append([]interface{}{"assert consume time: ", took, "!=", in}, msg...)...)
+	}
+}
+
+func assertAccuracy(t *testing.T, consumed, bandwidth uint64, dt time.Duration) {
+	projected := uint64(time.Duration(bandwidth) * dt / time.Second)
+	accuracy := float64(consumed)/float64(projected) - 1.0
+	t.Log("total consumption =", consumed,
+		"projected =", projected,
+		"error =", accuracy, "in =", dt)
+
+	if math.Abs(accuracy) > 0.01 {
+		t.Error("something went wrong with accuracy:",
+			"total consumption =", consumed,
+			"projected =", projected,
+			"error =", accuracy, "in =", dt)
+	}
+}
+
+func TestBucket_RateBurst(t *testing.T) {
+	t.Run("burst smaller than rate", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucketRateBurst(10, 2)
+		b.SetClock(c)
+
+		assertEqU64(t, b.Consume(5), 2)
+		assertEqU64(t, b.TryConsumeUpTo(5), 0)
+
+		c.Advance(100 * time.Millisecond)
+		assertEqU64(t, b.TryConsumeUpTo(5), 1)
+
+		c.Advance(time.Second)
+		assertEqU64(t, b.TryConsumeUpTo(5), 2, "does not accumulate over burst")
+	})
+
+	t.Run("burst larger than rate", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucketRateBurst(10, 30)
+		b.SetClock(c)
+
+		assertEqU64(t, b.Consume(100), 30)
+
+		c.Advance(time.Second)
+		assertEqU64(t, b.TryConsumeUpTo(100), 10)
+
+		c.Advance(5 * time.Second)
+		assertEqU64(t, b.TryConsumeUpTo(100), 30)
+	})
+
+	t.Run("set rate and burst", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+		b.SetRate(100)
+		b.SetBurst(5)
+		assertEqU64(t, b.Rate(), 100)
+		assertEqU64(t, b.Burst(), 5)
+
+		assertEqU64(t, b.Consume(10), 5)
+		c.Advance(20 * time.Millisecond)
+		assertEqU64(t, b.TryConsumeUpTo(10), 2)
+
+		b.SetRate(0)
+		assertTrue(t, b.Unlimited())
+		assertEqU64(t, b.Consume(1000), 1000)
+	})
+}
+
+func TestBucket_Fraction(t *testing.T) {
+	t.Run("carries fraction of a token", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(5)
+		b.SetClock(c)
+
+		assertEqU64(t, b.Consume(5), 5)
+
+		consumed := uint64(0)
+		for i := 0; i < 100; i++ {
+			c.Advance(10 * time.Millisecond)
+			consumed += b.TryConsumeUpTo(5)
+		}
+		assertEqU64(t, consumed, 5)
+	})
+
+	t.Run("sub ms precision", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(3)
+		b.SetClock(c)
+
+		assertEqU64(t, b.Consume(3), 3)
+		r := b.Reserve(1)
+		assertEqDuration(t, r.Delay(), 333333334*time.Nanosecond)
+		r.Cancel()
+
+		c.Advance(333333333 * time.Nanosecond)
+		assertTrue(t, !b.TryConsume(1))
+		c.Advance(time.Nanosecond)
+		assertTrue(t, b.TryConsume(1))
+	})
+
+	t.Run("rate below 1 token per sec", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucketEvery(10*time.Minute, 1)
+		b.SetClock(c)
+
+		assertEqU64(t, b.Consume(1), 1)
+		assertEqDuration(t, b.Reserve(1).Delay(), 10*time.Minute)
+		b.Reset()
+		assertTrue(t, b.TryConsume(1))
+
+		c.Advance(10*time.Minute - time.Second)
+		assertTrue(t, !b.TryConsume(1))
+		c.Advance(time.Second)
+		assertTrue(t, b.TryConsume(1))
+
+		tokens, per := b.RatePer()
+		assertEqU64(t, tokens, 1)
+		assertEqDuration(t, per, 10*time.Minute)
+		assertEqU64(t, b.Rate(), 0)
+	})
+
+	t.Run("rational rate", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucketRatePer(3, 2*time.Second, 3)
+		b.SetClock(c)
+
+		assertEqU64(t, b.Consume(3), 3)
+		c.Advance(time.Second)
+		assertEqU64(t, b.TryConsumeUpTo(3), 1)
+		c.Advance(time.Second)
+		assertEqU64(t, b.TryConsumeUpTo(3), 2)
+	})
+}
+
+func TestBucket_ClockDeadline(t *testing.T) {
+	// the deadline is in the wall time, it does not
+	// tell the wait would not fit into it by the clock
+	c := throttletest.NewClock(time.Now().Add(24 * time.Hour))
+	b := throttle.NewBucket(10)
+	b.SetClock(c)
+	assertEqU64(t, b.Consume(10), 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		_, err := b.ConsumeContext(ctx, 10)
+		done <- err
+	}()
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	assertNoErr(t, <-done)
+}
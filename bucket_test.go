@@ -1,155 +1,99 @@
 package throttle
 
 import (
-	"math"
-	"math/rand"
+	"context"
 	"testing"
 	"time"
 )
 
-func TestBucket_Consume(t *testing.T) {
+func TestBucket_ConsumeContext(t *testing.T) {
 	t.Run("returns immediately for unlimited bucket", func(t *testing.T) {
 		b := NewBucket(0)
-		assertEqU64(t, b.Consume(0), 0)
-		assertEqU64(t, b.Consume(1), 1)
-		assertEqU64(t, b.Consume(100), 100)
-		assertEqU64(t, b.capacity, 0)
-		assertEqU64(t, b.fill, 0)
-		assertEqU64(t, b.ts, 0)
+		n, err := b.ConsumeContext(context.Background(), 100)
+		assertEqU64(t, n, 100)
+		assertNoErr(t, err)
 	})
 
-	t.Run("generates 1 token evenly", func(t *testing.T) {
-		t.Parallel()
-		b := NewBucket(1)
-		assertConsumeMax(t, b, 1, 1, time.Millisecond)
-		assertConsumeMin(t, b, 1, 1, time.Second)
-	})
-
-	t.Run("does not allow over feeding", func(t *testing.T) {
-		t.Parallel()
-		b := NewBucket(1)
-		assertEqU64(t, b.Consume(2), 1)
-		assertConsumeMin(t, b, 2, 1, time.Second)
-	})
-
-	t.Run("capacity at once", func(t *testing.T) {
-		t.Parallel()
+	t.Run("does not consume with done context", func(t *testing.T) {
 		b := NewBucket(10)
-
-		assertConsumeMax(t, b, 100, 10, time.Millisecond, "consume all tokens first")
-		assertEqU64(t, b.fill, b.capacity)
-
-		assertConsumeMax(t, b, 100, 10, time.Second)
-		assertEqU64(t, b.fill, b.capacity)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		n, err := b.ConsumeContext(ctx, 1)
+		assertEqU64(t, n, 0)
+		assertErr(t, err, context.Canceled)
+		assertEqU64(t, b.Fill(), 0)
 	})
 
-	t.Run("artificial timeout generates tokens", func(t *testing.T) {
+	t.Run("returns promptly on cancel", func(t *testing.T) {
 		t.Parallel()
 		b := NewBucket(10)
+		assertConsumeMax(t, b, 10, 10, time.Millisecond, "consume all tokens first")
 
-		assertConsumeMax(t, b, 100, 10, time.Millisecond, "consume all tokens first")
-		assertEqU64(t, b.fill, b.capacity)
-
-		assertConsumeMax(t, b, 1, 1, 100*time.Millisecond)
-		assertEqU64(t, b.fill, b.capacity)
-
-		time.Sleep(100 * time.Millisecond)
-		assertConsumeMax(t, b, 1, 1, time.Millisecond)
-		assertEqU64(t, b.fill, b.capacity)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
 
-		time.Sleep(200 * time.Millisecond)
-		assertConsumeMax(t, b, 1, 1, time.Millisecond)
-		assertEqU64(t, b.fill, b.capacity-1)
-
-		assertConsumeMax(t, b, 1, 1, time.Millisecond)
-		assertEqU64(t, b.fill, b.capacity)
-	})
-
-	t.Run("all twice", func(t *testing.T) {
-		t.Parallel()
-		b := NewBucket(1000)
-
-		assertConsumeMax(t, b, 2000, 1000, time.Millisecond, "consume all tokens first")
-		assertEqU64(t, b.fill, b.capacity)
-		assertConsumeMax(t, b, 2000, 1000, time.Second)
-		assertEqU64(t, b.fill, b.capacity)
+		start := time.Now()
+		n, err := b.ConsumeContext(ctx, 10)
+		assertEqU64(t, n, 0)
+		assertErr(t, err, context.Canceled)
+		if time.Since(start) > 200*time.Millisecond {
+			t.Error("cancel took too long:", time.Since(start))
+		}
 	})
 
-	t.Run("flat/5s", func(t *testing.T) {
-		const window = 5 * time.Second
-		const bandwidth = 1000 // bytes / sec
-
-		t.Parallel()
-		b := NewBucket(1000)
+	t.Run("does not wait past deadline", func(t *testing.T) {
+		b := NewBucket(10)
+		assertConsumeMax(t, b, 10, 10, time.Millisecond, "consume all tokens first")
 
-		assertConsumeMax(t, b, 2*bandwidth, bandwidth, time.Millisecond, "consume all tokens first")
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
 
-		consumed := uint64(0)
 		start := time.Now()
-		for {
-			assertConsumeMax(t, b, 10, 10, 10*time.Millisecond)
-			consumed += 10
-			// t.Log("consumed =", consumed, ", dt =", time.Since(start))
-			if time.Since(start) >= window {
-				break
-			}
-		}
-
-		dt := time.Since(start)
-		projected := uint64(bandwidth * dt / time.Second)
-		accuracy := float64(consumed)/float64(projected) - 1.0
-		t.Log("total consumption =", consumed,
-			"projected =", projected,
-			"error =", accuracy, "in =", dt)
-
-		if math.Abs(accuracy) > 0.01 {
-			t.Error("something went wrong with accuracy:",
-				"total consumption =", consumed,
-				"projected =", projected,
-				"error =", accuracy, "in =", dt)
+		n, err := b.ConsumeContext(ctx, 10)
+		assertEqU64(t, n, 0)
+		assertErr(t, err, context.DeadlineExceeded)
+		if time.Since(start) > 10*time.Millisecond {
+			t.Error("waited for unreachable deadline:", time.Since(start))
 		}
 	})
+}
 
-	t.Run("rnd/5s", func(t *testing.T) {
-		const window = 5 * time.Second
-		const bandwidth = 1000 // bytes / sec
-
-		t.Parallel()
-		b := NewBucket(bandwidth)
-
-		assertConsumeMax(t, b, 2*bandwidth, bandwidth, time.Millisecond, "consume all tokens first")
+func TestBucket_TryConsume(t *testing.T) {
+	t.Run("always succeeds for unlimited bucket", func(t *testing.T) {
+		b := NewBucket(0)
+		assertTrue(t, b.TryConsume(100))
+		assertEqU64(t, b.TryConsumeUpTo(100), 100)
+	})
 
-		consumed := uint64(0)
-		start := time.Now()
-		for {
-			try := uint64(rand.Intn(2 * bandwidth))
-			dc := b.Consume(try)
-			if dc < 1 {
-				t.Error("invalid consume")
-			}
-			consumed += dc
-			// t.Log("consumed =", consumed, ", dt =", time.Since(start))
-			if time.Since(start) >= window {
-				break
-			}
-		}
+	t.Run("all or nothing", func(t *testing.T) {
+		b := NewBucket(10)
+		assertTrue(t, !b.TryConsume(11), "more than capacity")
+		assertTrue(t, b.TryConsume(7))
+		assertTrue(t, !b.TryConsume(4))
+		assertEqU64(t, b.Fill(), 7)
+		assertTrue(t, b.TryConsume(3))
+		assertEqU64(t, b.Fill(), 10)
+	})
 
-		dt := time.Since(start)
-		projected := uint64(bandwidth * dt / time.Second)
-		accuracy := float64(consumed)/float64(projected) - 1.0
-		t.Log("total consumption =", consumed,
-			"projected =", projected,
-			"error =", accuracy, "in =", dt)
-
-		if math.Abs(accuracy) > 0.01 {
-			t.Error("something went wrong with accuracy:",
-				"total consumption =", consumed,
-				"projected =", projected,
-				"error =", accuracy, "in =", dt)
-		}
+	t.Run("up to available", func(t *testing.T) {
+		b := NewBucket(10)
+		assertEqU64(t, b.TryConsumeUpTo(7), 7)
+		assertEqU64(t, b.TryConsumeUpTo(7), 3)
+		assertEqU64(t, b.TryConsumeUpTo(7), 0)
+		assertEqU64(t, b.Fill(), 10)
 	})
 }
 
+func TestBucket_Refund(t *testing.T) {
+	b := NewBucket(10)
+	assertEqU64(t, b.Consume(10), 10)
+	b.Refund(4)
+	assertEqU64(t, b.Fill(), 6)
+	assertTrue(t, b.TryConsume(4))
+	b.Refund(100)
+	assertEqU64(t, b.Fill(), 0)
+}
+
 func TestBucket_SetCapacity(t *testing.T) {
 	t.Run("change works", func(t *testing.T) {
 		b := NewBucket(0)
@@ -191,6 +135,24 @@ func assertConsumeMax(t *testing.T, b *Bucket, consume uint64, expected uint64,
 	}
 }
 
+func assertTrue(t *testing.T, val bool, msg ...interface{}) {
+	if !val {
+		t.Error(append([]interface{}{"assert true"}, msg...)...)
+	}
+}
+
+func assertNoErr(t *testing.T, err error, msg ...interface{}) {
+	if err != nil {
+		t.Error(append([]interface{}{"assert no error: ", err}, msg...)...)
+	}
+}
+
+func assertErr(t *testing.T, err, expected error, msg ...interface{}) {
+	if err != expected {
+		t.Error(append([]interface{}{"assert error: ", err, "!=", expected}, msg...)...)
+	}
+}
+
 func assertEqU64(t *testing.T, val, expected uint64, msg ...interface{}) {
 	if val != expected {
 		t.Error(append([]interface{}{"assert uint64: ", val, "!=", expected}, msg...)...)
@@ -0,0 +1,88 @@
+package throttle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sitano/throttle"
+	"github.com/sitano/throttle/throttletest"
+)
+
+func TestHierarchy_Class(t *testing.T) {
+	newRoot := func(c *throttletest.Clock) *throttle.Bucket {
+		root := throttle.NewBucket(1000)
+		root.SetClock(c)
+		root.SetUnitDivisor(1, 0)
+		return root
+	}
+	newLeaf := func(c *throttletest.Clock, root *throttle.Bucket, assured, ceil uint64) *throttle.Hierarchy {
+		h := throttle.NewHierarchy(root)
+		h.SetClock(c)
+		h.SetClass(assured, ceil)
+		return h
+	}
+
+	t.Run("borrows idle bandwidth up to ceil", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		root := newRoot(c)
+		newLeaf(c, root, 800, 1000)
+		borrower := newLeaf(c, root, 200, 1000)
+
+		assertEqU64(t, borrower.Consume(1000), 1000)
+		assertEqU64(t, root.Fill(), 1000)
+		assertEqU64(t, borrower.Leaf().Fill(), 1000)
+	})
+
+	t.Run("owner reclaims assured bandwidth", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		root := newRoot(c)
+		owner := newLeaf(c, root, 800, 1000)
+		borrower := newLeaf(c, root, 200, 1000)
+
+		assertEqU64(t, borrower.Consume(1000), 1000)
+
+		// owner does not wait for the borrowed tokens
+		assertEqU64(t, owner.Consume(800), 800)
+		assertEqU64(t, root.Fill(), 1800)
+
+		// borrower waits for the root to pay the debt
+		r := root.Reserve(100)
+		assertEqDuration(t, r.Delay(), 900*time.Millisecond)
+		r.Cancel()
+	})
+
+	t.Run("borrows the rest above assured", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		root := newRoot(c)
+		owner := newLeaf(c, root, 500, 1000)
+
+		assertEqU64(t, root.Consume(1000), 1000)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			_, err := owner.ConsumeContext(ctx, 800)
+			done <- err
+		}()
+
+		// 500 are assured, 300 are waited for
+		c.BlockUntil(1)
+		assertEqU64(t, root.Fill(), 1500)
+		cancel()
+		assertErr(t, <-done, context.Canceled)
+
+		assertEqU64(t, root.Fill(), 1000)
+		assertEqU64(t, owner.Leaf().Fill(), 0)
+		assertEqU64(t, owner.Consume(500), 500, "assured tokens are given back")
+		assertEqU64(t, root.Fill(), 1500)
+	})
+
+	t.Run("no guarantee by default", func(t *testing.T) {
+		root := throttle.NewBucket(1000)
+		h := throttle.NewHierarchy(root)
+		assertEqU64(t, h.Assured(), 0)
+		assertEqU64(t, root.Consume(1000), 1000)
+		assertTrue(t, !h.TryConsume(1))
+	})
+}
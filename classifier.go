@@ -0,0 +1,124 @@
+package throttle
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Class is the throttling class of an incoming connection
+// chosen by a Classifier. Zero fields keep the defaults
+// of the listener unless they are marked in Set.
+type Class struct {
+	// Conn replaces the accepted connection, e.g. to give back
+	// the bytes the classifier has read from it.
+	Conn net.Conn
+
+	// ReadParent and WriteParent are the parents of the connection
+	// buckets instead of the server class (or source) buckets.
+	ReadParent  *Bucket
+	WriteParent *Bucket
+
+	// ReadCapacity and WriteCapacity are the bandwidth
+	// of the connection.
+	ReadCapacity  uint64
+	WriteCapacity uint64
+	// Assured is the guaranteed bandwidth of the connection,
+	// see Hierarchy.SetClass.
+	Assured uint64
+
+	// Priority and Weight of the connection at the parents,
+	// see Hierarchy.SetPriority and Conn.SetWeight.
+	Priority int
+	Weight   uint64
+
+	// Set marks the fields which replace the defaults even
+	// if they are zero, e.g. the priority of 0 when the
+	// listener default is higher.
+	Set ClassFields
+}
+
+// ClassFields is a set of the fields of Class.
+type ClassFields uint
+
+const (
+	ClassReadCapacity ClassFields = 1 << iota
+	ClassWriteCapacity
+	ClassAssured
+	ClassPriority
+	ClassWeight
+)
+
+// Classifier chooses the class of an accepted connection,
+// e.g. by the local port, the remote network or the first
+// bytes of the stream.
+type Classifier func(conn net.Conn) Class
+
+// SetClassifier sets the classifier consulted for every admitted
+// connection before wrapping it. It runs in a goroutine of its own,
+// so a classifier waiting for the first bytes of a silent peer does
+// not stall Accept for other connections. It should still set a read
+// deadline if it reads from the connection, as the connection counts
+// towards the accept limits meanwhile (see SetMaxConns). The nil
+// classifier gives all connections the defaults.
+func (l *Listener) SetClassifier(classifier Classifier) {
+	l.mu.Lock()
+	l.classifier = classifier
+	l.mu.Unlock()
+}
+
+// Classifier returns the classifier of the connections.
+func (l *Listener) Classifier() Classifier {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.classifier
+}
+
+// classify returns the class of the conn: the defaults of the
+// listener overridden by the non-zero or set fields of the class
+// chosen by the classifier.
+func (l *Listener) classify(conn net.Conn, src *source) Class {
+	var class = Class{
+		Conn:          conn,
+		ReadParent:    &l.rb,
+		WriteParent:   &l.wb,
+		ReadCapacity:  atomic.LoadUint64(&l.connRead),
+		WriteCapacity: atomic.LoadUint64(&l.connWrite),
+		Assured:       atomic.LoadUint64(&l.connAssured),
+		Priority:      int(atomic.LoadInt64(&l.connPriority)),
+	}
+	if src != nil {
+		class.ReadParent, class.WriteParent = &src.rb, &src.wb
+	}
+
+	var classifier = l.Classifier()
+	if classifier == nil {
+		return class
+	}
+
+	var c = classifier(conn)
+	if c.Conn != nil {
+		class.Conn = c.Conn
+	}
+	if c.ReadParent != nil {
+		class.ReadParent = c.ReadParent
+	}
+	if c.WriteParent != nil {
+		class.WriteParent = c.WriteParent
+	}
+	if c.ReadCapacity > 0 || c.Set&ClassReadCapacity != 0 {
+		class.ReadCapacity = c.ReadCapacity
+	}
+	if c.WriteCapacity > 0 || c.Set&ClassWriteCapacity != 0 {
+		class.WriteCapacity = c.WriteCapacity
+	}
+	if c.Assured > 0 || c.Set&ClassAssured != 0 {
+		class.Assured = c.Assured
+	}
+	if c.Priority != 0 || c.Set&ClassPriority != 0 {
+		class.Priority = c.Priority
+	}
+	if c.Weight > 0 || c.Set&ClassWeight != 0 {
+		class.Weight = c.Weight
+	}
+	return class
+}
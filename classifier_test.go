@@ -0,0 +1,124 @@
+package throttle
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// peekedConn gives back the bytes read by a classifier.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func TestListener_Classifier(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	wrap := WrapListener(ln)
+	defer wrap.Close()
+	wrap.SetConnCapacity(1000)
+	wrap.SetConnPriority(1)
+
+	var control Bucket
+	control.SetCapacity(100)
+
+	// control connections start with 'c'
+	wrap.SetClassifier(func(conn net.Conn) Class {
+		var b = make([]byte, 1)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _ := conn.Read(b)
+		_ = conn.SetReadDeadline(time.Time{})
+
+		peeked := &peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(b[:n]), conn)}
+		if n == 1 && b[0] == 'i' {
+			// interactive connections have no priority
+			return Class{Conn: peeked, Set: ClassPriority}
+		}
+		if n == 1 && b[0] == 'c' {
+			return Class{
+				Conn:         peeked,
+				ReadParent:   &control,
+				WriteParent:  &control,
+				ReadCapacity: 10,
+				Priority:     5,
+				Weight:       3,
+			}
+		}
+		return Class{Conn: peeked}
+	})
+
+	accept := func(payload string) *Conn {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("net.Dial:", err)
+		}
+		_, _ = client.Write([]byte(payload))
+		_ = client.Close()
+
+		conn, err := wrap.Accept()
+		if err != nil {
+			t.Fatal("accept:", err)
+		}
+		return conn.(*Conn)
+	}
+
+	conn := accept("control")
+	assertTrue(t, conn.ReadHierarchy().Root() == &control)
+	assertTrue(t, conn.WriteHierarchy().Root() == &control)
+	assertEqU64(t, conn.ReadHierarchy().Leaf().Capacity(), 10)
+	assertEqU64(t, conn.WriteHierarchy().Leaf().Capacity(), 1000)
+	assertEqU64(t, uint64(conn.ReadHierarchy().Priority()), 5)
+	assertEqU64(t, conn.ReadHierarchy().Weight(), 3)
+	// the buckets of the classifier are left as they are
+	assertTrue(t, !control.FIFO())
+	conn.Reset()
+	data, err := ioutil.ReadAll(conn)
+	assertNoErr(t, err)
+	assertTrue(t, string(data) == "control", string(data))
+	assertNoErr(t, conn.Close())
+
+	conn = accept("bulk")
+	assertTrue(t, conn.ReadHierarchy().Root() == wrap.ReadBucket())
+	assertEqU64(t, conn.ReadHierarchy().Leaf().Capacity(), 1000)
+	assertEqU64(t, uint64(conn.ReadHierarchy().Priority()), 1)
+	assertEqU64(t, conn.ReadHierarchy().Weight(), 1)
+	conn.Reset()
+	data, err = ioutil.ReadAll(conn)
+	assertNoErr(t, err)
+	assertTrue(t, string(data) == "bulk", string(data))
+	assertNoErr(t, conn.Close())
+
+	conn = accept("interactive")
+	assertEqU64(t, uint64(conn.ReadHierarchy().Priority()), 0)
+	assertEqU64(t, conn.ReadHierarchy().Leaf().Capacity(), 1000)
+	assertNoErr(t, conn.Close())
+	assertEqU64(t, uint64(wrap.ActiveConns()), 0)
+
+	t.Run("silent peer does not stall accept", func(t *testing.T) {
+		silent, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("net.Dial:", err)
+		}
+		defer silent.Close()
+
+		start := time.Now()
+		conn := accept("bulk")
+		defer conn.Close()
+		assertTrue(t, time.Since(start) < 500*time.Millisecond, "accepted in", time.Since(start))
+
+		// the silent one gets the defaults at the deadline
+		conn2, err := wrap.Accept()
+		assertNoErr(t, err)
+		assertNoErr(t, conn2.Close())
+	})
+}
@@ -0,0 +1,57 @@
+package throttle_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sitano/throttle"
+	"github.com/sitano/throttle/throttletest"
+)
+
+func TestBucket_Clock(t *testing.T) {
+	t.Run("generates tokens as clock goes", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+
+		assertEqU64(t, b.Consume(100), 10)
+		assertEqU64(t, b.Fill(), 10)
+
+		c.Advance(300 * time.Millisecond)
+		assertEqU64(t, b.Consume(3), 3)
+		assertEqU64(t, b.Fill(), 10)
+
+		c.Advance(time.Second)
+		assertEqU64(t, b.Consume(1), 1)
+		assertEqU64(t, b.Fill(), 1)
+	})
+
+	t.Run("waits for the clock", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+
+		assertEqU64(t, b.Consume(10), 10)
+
+		done := make(chan uint64)
+		go func() {
+			done <- b.Consume(5)
+		}()
+
+		c.BlockUntil(1)
+		select {
+		case <-done:
+			t.Fatal("consumed without tokens")
+		default:
+		}
+
+		c.Advance(500 * time.Millisecond)
+		select {
+		case n := <-done:
+			assertEqU64(t, n, 5)
+			assertEqU64(t, b.Fill(), 10)
+		case <-time.After(time.Second):
+			t.Error("consumer was not woken")
+		}
+	})
+}
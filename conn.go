@@ -1,77 +1,125 @@
 package throttle
 
 import (
-	"errors"
+	"context"
+	"io"
 	"net"
-	"strconv"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Conn throttles net.Conn overall read/write bandwidth
-// using buckets hierarchy. Throttling does not count
-// deadlines in current impl.
+// Conn throttles net.Conn read and write bandwidth
+// independently using a buckets hierarchy per direction.
+// Waiting for the bandwidth stops at the deadlines
+// of the conn or when it is closed.
 type Conn struct {
 	c net.Conn
 
-	h Hierarchy
+	// closed is done when the conn is closed
+	closed context.Context
+	close  context.CancelFunc
+	// onClose is called once on the first Close
+	onClose func()
+	once    sync.Once
+	// queue turns FIFO mode on at the parents the owner of the
+	// conn configures, so they honour its weight and priority,
+	// see queueAt
+	queue func()
+
+	r Hierarchy // ingress
+	w Hierarchy // egress
+
+	// deadlines in unix ns, 0 means no deadline
+	rdl int64
+	wdl int64
+
+	// bytes transferred
+	read    uint64
+	written uint64
 }
 
 var _ net.Conn = (*Conn)(nil)
 var _ Capacity = (*Conn)(nil)
+var _ io.ReaderFrom = (*Conn)(nil)
+var _ io.WriterTo = (*Conn)(nil)
 
 func WrapConn(c net.Conn) *Conn {
-	return &Conn{c: c}
+	return WrapConnWithParents(c, nil, nil)
 }
 
+// WrapConnWithParent returns a conn throttled by its own
+// buckets and the parent p in both directions. The parent
+// can be any bucket of a tree of buckets (see Bucket.SetParent).
 func WrapConnWithParent(c net.Conn, p *Bucket) *Conn {
-	return &Conn{c: c, h: *NewHierarchy(p)}
+	return WrapConnWithParents(c, p, p)
 }
 
-// Read can't peek utilization of the read buffer
-// in advance. So doing our best we are just consuming
-// min(len(leaf), bucket.capacity) from the bucket and return it.
-func (c *Conn) Read(b []byte) (n int, err error) {
-	if len(b) == 0 {
-		return 0, nil
-	}
+// WrapConnWithParents returns a conn throttled by its own
+// buckets and the parent read bucket for reads and the parent
+// write bucket for writes.
+func WrapConnWithParents(c net.Conn, read, write *Bucket) *Conn {
+	var conn = &Conn{c: c, r: *NewHierarchy(read), w: *NewHierarchy(write)}
+	conn.closed, conn.close = context.WithCancel(context.Background())
+	return conn
+}
 
-	// reserved = min(len(leaf), bucket.capacity)
-	// as there is no sense to wait more than a sec
-	// not knowing read buf utilization.
-	//
-	// so do the best effort and configure size of
-	// recv buf leaf knowing your throttled bandwidth
-	// and application level traffic pattern.
-	reserved := c.h.Consume(uint64(len(b)))
+// Read consumes min(len(b), capacity) from the read
+// hierarchy and refunds what was not read.
+func (c *Conn) Read(b []byte) (n int, err error) {
+	ctx, cancel := deadlineContext(c.closed, atomic.LoadInt64(&c.rdl))
+	defer cancel()
 
-	return c.c.Read(b[:reserved])
+	n, err = read(ctx, &c.r, c.c, b)
+	atomic.AddUint64(&c.read, uint64(n))
+	return n, throttleError(err)
 }
 
-// Write naively throttles amount of write. It could
-// try to push first available tokens as soon as it could,
-// but not this time.
+// Write writes b in chunks consumed from the write
+// hierarchy. If the deadline comes while waiting for
+// the bandwidth or the conn is closed, it returns the
+// number of bytes written so far.
 func (c *Conn) Write(b []byte) (n int, err error) {
-	var n2 int
+	ctx, cancel := deadlineContext(c.closed, atomic.LoadInt64(&c.wdl))
+	defer cancel()
 
-	for len(b) > 0 {
-		reserved := c.h.Consume(uint64(len(b)))
-		if reserved == 0 {
-			return n, errors.New("consumed 0 requested " + strconv.Itoa(len(b)))
-		}
+	n, err = write(ctx, &c.w, c.c, b)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, throttleError(err)
+}
 
-		n2, err = c.c.Write(b[:reserved])
-		n += n2
-		if err != nil {
-			return n, err
-		}
+// ReadFrom writes the data read from r until io.EOF in chunks
+// consumed from the write hierarchy. Chunks are handed to the
+// underlying conn, so it can use its zero-copy path.
+func (c *Conn) ReadFrom(r io.Reader) (n int64, err error) {
+	ctx, cancel := deadlineContext(c.closed, atomic.LoadInt64(&c.wdl))
+	defer cancel()
 
-		b = b[reserved:]
-	}
+	n, err = copyChunks(ctx, &c.w, c.c, r)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, throttleError(err)
+}
+
+// WriteTo writes the data read from the conn until io.EOF to w
+// in chunks consumed from the read hierarchy. Chunks are handed
+// to w, so it can use its zero-copy path.
+func (c *Conn) WriteTo(w io.Writer) (n int64, err error) {
+	ctx, cancel := deadlineContext(c.closed, atomic.LoadInt64(&c.rdl))
+	defer cancel()
 
-	return n, err
+	n, err = copyChunks(ctx, &c.r, w, c.c)
+	atomic.AddUint64(&c.read, uint64(n))
+	return n, throttleError(err)
 }
 
+// Close closes the conn. Reads and writes waiting for the
+// bandwidth return net.ErrClosed.
 func (c *Conn) Close() error {
+	c.close()
+	if c.onClose != nil {
+		c.once.Do(c.onClose)
+	}
 	return c.c.Close()
 }
 
@@ -84,23 +132,145 @@ func (c *Conn) RemoteAddr() net.Addr {
 }
 
 func (c *Conn) SetDeadline(t time.Time) error {
+	atomic.StoreInt64(&c.rdl, deadlineNano(t))
+	atomic.StoreInt64(&c.wdl, deadlineNano(t))
 	return c.c.SetDeadline(t)
 }
 
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	atomic.StoreInt64(&c.rdl, deadlineNano(t))
 	return c.c.SetReadDeadline(t)
 }
 
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	atomic.StoreInt64(&c.wdl, deadlineNano(t))
 	return c.c.SetWriteDeadline(t)
 }
 
+// SetCapacity sets both the read and the write capacity.
 func (c *Conn) SetCapacity(capacity uint64) {
-	c.h.SetCapacity(capacity)
+	c.SetReadCapacity(capacity)
+	c.SetWriteCapacity(capacity)
+}
+
+func (c *Conn) SetReadCapacity(capacity uint64) {
+	c.r.SetCapacity(capacity)
+	// forgive race condition for concurrent sets
+	c.r.leaf.SetFill(capacity)
+}
+
+func (c *Conn) SetWriteCapacity(capacity uint64) {
+	c.w.SetCapacity(capacity)
+	// forgive race condition for concurrent sets
+	c.w.leaf.SetFill(capacity)
+}
+
+// SetClass sets the assured and the ceil rates of the conn
+// in both directions, see Hierarchy.SetClass.
+func (c *Conn) SetClass(assured, ceil uint64) {
+	c.SetReadClass(assured, ceil)
+	c.SetWriteClass(assured, ceil)
+}
+
+func (c *Conn) SetReadClass(assured, ceil uint64) {
+	c.r.SetClass(assured, ceil)
+	// forgive race condition for concurrent sets
+	c.r.leaf.SetFill(ceil)
+}
+
+func (c *Conn) SetWriteClass(assured, ceil uint64) {
+	c.w.SetClass(assured, ceil)
 	// forgive race condition for concurrent sets
-	c.h.leaf.SetFill(capacity)
+	c.w.leaf.SetFill(ceil)
 }
 
 func (c *Conn) Reset() {
-	c.h.leaf.SetFill(0)
+	c.r.Reset()
+	c.w.Reset()
+}
+
+// SetClock sets the source of time of the conn throttling.
+// It must be set before the conn is used.
+func (c *Conn) SetClock(clock Clock) {
+	c.r.SetClock(clock)
+	c.w.SetClock(clock)
+}
+
+// SetWeight sets the share of the conn at the parents
+// relative to other conns, see Hierarchy.SetWeight. The
+// buckets of Listener and Dialer among the parents turn
+// FIFO mode on for the weight above 1.
+func (c *Conn) SetWeight(weight uint64) {
+	c.r.SetWeight(weight)
+	c.w.SetWeight(weight)
+	if weight > 1 && c.queue != nil {
+		c.queue()
+	}
+}
+
+// SetPriority sets the priority of the conn at the parents,
+// see Hierarchy.SetPriority. The buckets of Listener and
+// Dialer among the parents turn FIFO mode on for non-zero
+// priorities.
+func (c *Conn) SetPriority(priority int) {
+	c.r.SetPriority(priority)
+	c.w.SetPriority(priority)
+	if priority != 0 && c.queue != nil {
+		c.queue()
+	}
+}
+
+// ReadHierarchy returns the buckets throttling reads.
+func (c *Conn) ReadHierarchy() *Hierarchy {
+	return &c.r
+}
+
+// WriteHierarchy returns the buckets throttling writes.
+func (c *Conn) WriteHierarchy() *Hierarchy {
+	return &c.w
+}
+
+// queueAt returns the function which turns FIFO mode on at
+// the ancestors of the conn among the owned buckets.
+func queueAt(c *Conn, owned ...*Bucket) func() {
+	return func() {
+		for _, h := range []*Hierarchy{&c.r, &c.w} {
+			for p := h.root; p != nil; p = p.parent {
+				for _, b := range owned {
+					if p == b {
+						p.SetFIFO(true)
+					}
+				}
+			}
+		}
+	}
+}
+
+func deadlineNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// deadlineContext returns the context of an operation bounded
+// by the deadline in unix ns. Deadlines are in the wall time
+// as of net.Conn.
+func deadlineContext(parent context.Context, deadline int64) (context.Context, context.CancelFunc) {
+	if deadline == 0 {
+		return parent, func() {}
+	}
+	return context.WithDeadline(parent, time.Unix(0, deadline))
+}
+
+// throttleError converts an error of waiting for the bandwidth
+// into the error of net.Conn.
+func throttleError(err error) error {
+	switch err {
+	case context.DeadlineExceeded:
+		return os.ErrDeadlineExceeded
+	case context.Canceled:
+		return net.ErrClosed
+	}
+	return err
 }
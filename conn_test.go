@@ -3,8 +3,11 @@ package throttle
 
 import (
 	"context"
+	"io"
+	"io/ioutil"
 	"math"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -75,6 +78,125 @@ func TestConn(t *testing.T) {
 	})
 }
 
+func TestConn_Read(t *testing.T) {
+	t.Run("refunds unread tokens", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		conn := WrapConn(c1)
+		conn.SetCapacity(1000)
+		conn.Reset()
+
+		go func() {
+			_, _ = c2.Write(make([]byte, 10))
+		}()
+
+		n, err := conn.Read(make([]byte, 1000))
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+		assertEqU64(t, uint64(n), 10)
+		assertEqU64(t, conn.r.Leaf().Fill(), 10)
+	})
+
+	t.Run("refunds unread assured tokens", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		root := NewBucket(1000)
+		root.SetUnitDivisor(1, 0)
+		conn := WrapConnWithParent(c1, root)
+		conn.SetClass(100, 1000)
+		conn.Reset()
+
+		go func() {
+			_, _ = c2.Write(make([]byte, 10))
+		}()
+
+		n, err := conn.Read(make([]byte, 1000))
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+		assertEqU64(t, uint64(n), 10)
+		assertEqU64(t, conn.r.Leaf().Fill(), 10)
+		assertEqU64(t, root.Fill(), 10)
+		// assured tokens are refunded first
+		assertEqU64(t, conn.r.assured.Fill(), 0)
+
+		assertEqU64(t, conn.r.Consume(50), 50)
+		conn.r.Refund(20)
+		assertEqU64(t, conn.r.assured.Fill(), 30)
+
+		// tokens not taken at the assured rate don't go there
+		assertEqU64(t, conn.r.TryConsumeUpTo(10), 10)
+		conn.r.Refund(10)
+		assertEqU64(t, conn.r.assured.Fill(), 30)
+	})
+}
+
+func TestConn_Directions(t *testing.T) {
+	t.Run("read and write budgets are independent", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		conn := WrapConn(c1)
+		conn.SetReadCapacity(10)
+		conn.SetWriteCapacity(1000)
+		conn.Reset()
+
+		go func() {
+			_, _ = c2.Read(make([]byte, 1000))
+		}()
+
+		n, err := conn.Write(make([]byte, 1000))
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+		assertEqU64(t, uint64(n), 1000)
+		assertEqU64(t, conn.WriteHierarchy().Leaf().Fill(), 1000)
+		assertEqU64(t, conn.ReadHierarchy().Leaf().Fill(), 0)
+		assertTrue(t, conn.ReadHierarchy().TryConsume(10))
+	})
+
+	t.Run("listener roots per direction", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("net.Listen:", err)
+		}
+		wrap := WrapListener(ln)
+		defer wrap.Close()
+		wrap.SetReadCapacity(100)
+		wrap.SetWriteCapacity(200)
+		wrap.SetConnReadCapacity(10)
+		wrap.SetConnWriteCapacity(20)
+
+		go func() {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err == nil {
+				defer conn.Close()
+				_, _ = conn.Read(make([]byte, 1))
+			}
+		}()
+
+		conn, err := wrap.Accept()
+		if err != nil {
+			t.Fatal("accept:", err)
+		}
+		defer conn.Close()
+
+		c := conn.(*Conn)
+		assertTrue(t, c.ReadHierarchy().Root() == wrap.ReadBucket())
+		assertTrue(t, c.WriteHierarchy().Root() == wrap.WriteBucket())
+		assertEqU64(t, c.ReadHierarchy().Leaf().Capacity(), 10)
+		assertEqU64(t, c.WriteHierarchy().Leaf().Capacity(), 20)
+		assertEqU64(t, wrap.ReadBucket().Capacity(), 100)
+		assertEqU64(t, wrap.WriteBucket().Capacity(), 200)
+	})
+}
+
 type testSystem struct {
 	t *testing.T
 
@@ -255,3 +377,88 @@ func (m *MeasureBandwidth) Check(id uint64, buf uint64) {
 	}
 	check(args...)
 }
+
+func TestConn_Deadline(t *testing.T) {
+	t.Run("write stops at the deadline", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		conn := WrapConn(c1)
+		conn.SetWriteCapacity(10)
+		conn.Reset()
+
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, c2)
+		}()
+
+		assertNoErr(t, conn.SetWriteDeadline(time.Now().Add(100*time.Millisecond)))
+		start := time.Now()
+		n, err := conn.Write(make([]byte, 30))
+		assertErr(t, err, os.ErrDeadlineExceeded)
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Error("not a timeout:", err)
+		}
+		assertEqU64(t, uint64(n), 10)
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Error("write blocked past the deadline:", d)
+		}
+	})
+
+	t.Run("read in the past deadline", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		conn := WrapConn(c1)
+		conn.SetReadCapacity(10)
+
+		assertNoErr(t, conn.SetReadDeadline(time.Now().Add(-time.Second)))
+		n, err := conn.Read(make([]byte, 10))
+		assertErr(t, err, os.ErrDeadlineExceeded)
+		assertEqU64(t, uint64(n), 0)
+
+		assertNoErr(t, conn.SetDeadline(time.Time{}))
+		assertEqU64(t, uint64(atomic.LoadInt64(&conn.rdl)), 0)
+		assertEqU64(t, uint64(atomic.LoadInt64(&conn.wdl)), 0)
+	})
+}
+
+func TestConn_Close(t *testing.T) {
+	t.Run("close wakes waiting writer", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+
+		conn := WrapConn(c1)
+		conn.SetWriteCapacity(10)
+		conn.Reset()
+
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, c2)
+		}()
+
+		type result struct {
+			n   int
+			err error
+		}
+		done := make(chan result)
+		go func() {
+			n, err := conn.Write(make([]byte, 30))
+			done <- result{n, err}
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		assertNoErr(t, conn.Close())
+
+		select {
+		case r := <-done:
+			assertErr(t, r.err, net.ErrClosed)
+			assertEqU64(t, uint64(r.n), 10)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("write is still waiting after close")
+		}
+
+		_, err := conn.Read(make([]byte, 10))
+		assertErr(t, err, net.ErrClosed)
+	})
+}
@@ -0,0 +1,166 @@
+package throttle_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sitano/throttle"
+	"github.com/sitano/throttle/throttletest"
+)
+
+func TestConn_ReadFrom(t *testing.T) {
+	t.Run("writes in chunks of the budget", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		conn := throttle.WrapConn(c1)
+		conn.SetClock(c)
+		conn.SetWriteCapacity(10)
+		conn.Reset()
+
+		received := make(chan []byte)
+		go func() {
+			data, _ := ioutil.ReadAll(c2)
+			received <- data
+		}()
+
+		done := make(chan int64)
+		go func() {
+			n, err := conn.ReadFrom(strings.NewReader(strings.Repeat("x", 25)))
+			assertNoErr(t, err)
+			done <- n
+		}()
+
+		for i := 0; i < 2; i++ {
+			c.BlockUntil(1)
+			c.Advance(time.Second)
+		}
+		assertEqU64(t, uint64(<-done), 25)
+		assertEqU64(t, conn.WriteHierarchy().Leaf().Fill(), 5)
+
+		assertNoErr(t, conn.Close())
+		assertEqU64(t, uint64(len(<-received)), 25)
+	})
+
+	t.Run("limited reader", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		conn := throttle.WrapConn(c1)
+		conn.SetClock(c)
+		conn.SetWriteCapacity(10)
+		conn.Reset()
+
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, c2)
+		}()
+
+		src := strings.NewReader(strings.Repeat("x", 100))
+		lr := &io.LimitedReader{R: src, N: 15}
+		done := make(chan int64)
+		go func() {
+			n, err := conn.ReadFrom(lr)
+			assertNoErr(t, err)
+			done <- n
+		}()
+
+		c.BlockUntil(1)
+		c.Advance(time.Second)
+		assertEqU64(t, uint64(<-done), 15)
+		assertEqU64(t, uint64(lr.N), 0)
+		assertEqU64(t, uint64(src.Len()), 85)
+	})
+}
+
+func TestConn_WriteTo(t *testing.T) {
+	t.Run("reads in chunks of the budget", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		conn := throttle.WrapConn(c1)
+		conn.SetClock(c)
+		conn.SetReadCapacity(10)
+		conn.Reset()
+
+		go func() {
+			_, _ = c2.Write(bytes.Repeat([]byte("x"), 25))
+			_ = c2.Close()
+		}()
+
+		var buf bytes.Buffer
+		done := make(chan int64)
+		go func() {
+			n, err := conn.WriteTo(&buf)
+			assertNoErr(t, err)
+			done <- n
+		}()
+
+		for i := 0; i < 2; i++ {
+			c.BlockUntil(1)
+			c.Advance(time.Second)
+		}
+		assertEqU64(t, uint64(<-done), 25)
+		assertEqU64(t, uint64(buf.Len()), 25)
+	})
+
+	t.Run("proxy between throttled tcp conns", func(t *testing.T) {
+		const size = 1 << 20
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("net.Listen:", err)
+		}
+		defer ln.Close()
+
+		// client -> in ==proxy==> out -> sink
+		go func() {
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return
+			}
+			_, _ = client.Write(make([]byte, size))
+			_ = client.Close()
+		}()
+		in, err := ln.Accept()
+		if err != nil {
+			t.Fatal("accept:", err)
+		}
+		defer in.Close()
+
+		received := make(chan int64)
+		go func() {
+			sink, err := ln.Accept()
+			if err != nil {
+				received <- 0
+				return
+			}
+			n, _ := io.Copy(ioutil.Discard, sink)
+			received <- n
+		}()
+		out, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+
+		src := throttle.WrapConn(in)
+		dst := throttle.WrapConn(out)
+		dst.SetWriteCapacity(2 * size)
+		dst.Reset()
+
+		n, err := io.Copy(dst, src)
+		assertNoErr(t, err)
+		assertEqU64(t, uint64(n), size)
+		assertNoErr(t, dst.Close())
+		assertEqU64(t, uint64(<-received), size)
+	})
+}
@@ -0,0 +1,255 @@
+package throttle
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ContextDialer dials connections, e.g. *net.Dialer.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dialer dials throttled connections. As of Listener,
+// connections have own buckets per direction under the
+// client class buckets. Optionally connections to the same
+// host share host buckets between them and the client class.
+type Dialer struct {
+	d ContextDialer
+
+	// client class buckets
+	rb Bucket // ingress
+	wb Bucket // egress
+
+	// bandwidth per outgoing connection
+	connRead  uint64
+	connWrite uint64
+	// guaranteed bandwidth per outgoing connection
+	connAssured uint64
+	// priority of outgoing connections
+	connPriority int64
+
+	// bandwidth per destination host, 0 means no host buckets
+	hostRead  uint64
+	hostWrite uint64
+
+	mu    sync.Mutex
+	hosts map[string]*host
+}
+
+// host is the buckets shared by the connections to the same host.
+type host struct {
+	rb Bucket
+	wb Bucket
+
+	// number of live connections, guarded by Dialer.mu
+	refs int
+}
+
+// WrapDialer returns a dialer of throttled connections dialed
+// by d. The nil d dials with the zero net.Dialer.
+func WrapDialer(d ContextDialer) *Dialer {
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	return &Dialer{
+		d:     d,
+		hosts: make(map[string]*host),
+	}
+}
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext dials the address and returns a throttled conn.
+// The conn is a *Conn. It fits http.Transport.DialContext.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var read, write = &d.rb, &d.wb
+	var key = hostOf(address)
+	var h *host
+	if atomic.LoadUint64(&d.hostRead) > 0 || atomic.LoadUint64(&d.hostWrite) > 0 {
+		h = d.acquire(key)
+		read, write = &h.rb, &h.wb
+	}
+
+	conn, err := d.d.DialContext(ctx, network, address)
+	if err != nil {
+		if h != nil {
+			d.release(key, h)
+		}
+		return nil, err
+	}
+
+	assured := atomic.LoadUint64(&d.connAssured)
+	wrap := WrapConnWithParents(conn, read, write)
+	wrap.SetClock(d.rb.Clock())
+	wrap.SetReadClass(assured, atomic.LoadUint64(&d.connRead))
+	wrap.SetWriteClass(assured, atomic.LoadUint64(&d.connWrite))
+	wrap.queue = queueAt(wrap, read, write, &d.rb, &d.wb)
+	wrap.SetPriority(int(atomic.LoadInt64(&d.connPriority)))
+	if h != nil {
+		wrap.onClose = func() {
+			d.release(key, h)
+		}
+	}
+	return wrap, nil
+}
+
+// hostOf returns the host of the address or the address
+// itself if it has no port.
+func hostOf(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// acquire returns the buckets of the host and holds them
+// until release.
+func (d *Dialer) acquire(key string) *host {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h, ok := d.hosts[key]
+	if !ok {
+		h = &host{}
+		h.rb.SetParent(&d.rb)
+		h.wb.SetParent(&d.wb)
+		h.rb.SetClock(d.rb.Clock())
+		h.wb.SetClock(d.wb.Clock())
+		h.rb.SetCapacity(atomic.LoadUint64(&d.hostRead))
+		h.wb.SetCapacity(atomic.LoadUint64(&d.hostWrite))
+		d.hosts[key] = h
+	}
+	h.refs++
+	return h
+}
+
+// release forgets the buckets of the host when there
+// are no more connections to it.
+func (d *Dialer) release(key string, h *host) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h.refs--
+	if h.refs == 0 && d.hosts[key] == h {
+		delete(d.hosts, key)
+	}
+}
+
+// Hosts returns the number of the destination hosts
+// the dialer keeps buckets for.
+func (d *Dialer) Hosts() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.hosts)
+}
+
+// SetCapacity sets both the read and the write capacity
+// of the client class.
+func (d *Dialer) SetCapacity(capacity uint64) {
+	d.SetReadCapacity(capacity)
+	d.SetWriteCapacity(capacity)
+}
+
+func (d *Dialer) SetReadCapacity(capacity uint64) {
+	d.rb.SetCapacity(capacity)
+	// forgive race condition for concurrent sets
+	d.rb.SetFill(capacity)
+}
+
+func (d *Dialer) SetWriteCapacity(capacity uint64) {
+	d.wb.SetCapacity(capacity)
+	// forgive race condition for concurrent sets
+	d.wb.SetFill(capacity)
+}
+
+func (d *Dialer) Reset() {
+	d.rb.SetFill(0)
+	d.wb.SetFill(0)
+}
+
+// SetConnCapacity sets both the read and the write
+// capacity of outgoing connections.
+func (d *Dialer) SetConnCapacity(capacity uint64) {
+	d.SetConnReadCapacity(capacity)
+	d.SetConnWriteCapacity(capacity)
+}
+
+func (d *Dialer) SetConnReadCapacity(capacity uint64) {
+	atomic.StoreUint64(&d.connRead, capacity)
+}
+
+func (d *Dialer) SetConnWriteCapacity(capacity uint64) {
+	atomic.StoreUint64(&d.connWrite, capacity)
+}
+
+// SetConnClass sets the assured and the ceil bandwidth of
+// outgoing connections in both directions, see Hierarchy.SetClass.
+func (d *Dialer) SetConnClass(assured, ceil uint64) {
+	atomic.StoreUint64(&d.connAssured, assured)
+	d.SetConnCapacity(ceil)
+}
+
+// SetConnPriority sets the priority of outgoing connections at
+// the client class buckets, see Listener.SetConnPriority.
+func (d *Dialer) SetConnPriority(priority int) {
+	if priority != 0 {
+		d.SetFIFO(true)
+	}
+	atomic.StoreInt64(&d.connPriority, int64(priority))
+}
+
+// SetHostCapacity sets both the read and the write capacity
+// shared by the connections to the same host. It applies to
+// hosts without live connections. The capacity of 0 in both
+// directions turns host buckets off.
+func (d *Dialer) SetHostCapacity(capacity uint64) {
+	d.SetHostReadCapacity(capacity)
+	d.SetHostWriteCapacity(capacity)
+}
+
+func (d *Dialer) SetHostReadCapacity(capacity uint64) {
+	atomic.StoreUint64(&d.hostRead, capacity)
+}
+
+func (d *Dialer) SetHostWriteCapacity(capacity uint64) {
+	atomic.StoreUint64(&d.hostWrite, capacity)
+}
+
+// SetFIFO makes the client class buckets serve connections
+// in the order of priority and arrival, see Bucket.SetFIFO.
+func (d *Dialer) SetFIFO(fifo bool) {
+	d.rb.SetFIFO(fifo)
+	d.wb.SetFIFO(fifo)
+}
+
+// SetParent attaches the client class buckets to a parent
+// in a tree of buckets. It must be set before the first Dial.
+func (d *Dialer) SetParent(parent *Bucket) {
+	d.rb.SetParent(parent)
+	d.wb.SetParent(parent)
+}
+
+// ReadBucket returns the client class bucket of reads.
+// It can be a parent for other buckets.
+func (d *Dialer) ReadBucket() *Bucket {
+	return &d.rb
+}
+
+// WriteBucket returns the client class bucket of writes.
+// It can be a parent for other buckets.
+func (d *Dialer) WriteBucket() *Bucket {
+	return &d.wb
+}
+
+// SetClock sets the source of time of the client class buckets
+// and of the dialed connections. It must be set before the
+// first Dial.
+func (d *Dialer) SetClock(clock Clock) {
+	d.rb.SetClock(clock)
+	d.wb.SetClock(clock)
+}
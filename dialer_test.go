@@ -0,0 +1,129 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(ioutil.Discard, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	t.Run("shared root and conn capacity", func(t *testing.T) {
+		d := WrapDialer(nil)
+		d.SetReadCapacity(100)
+		d.SetWriteCapacity(200)
+		d.SetConnReadCapacity(10)
+		d.SetConnWriteCapacity(20)
+
+		conn, err := d.DialContext(context.Background(), "tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		defer conn.Close()
+
+		c := conn.(*Conn)
+		assertTrue(t, c.ReadHierarchy().Root() == d.ReadBucket())
+		assertTrue(t, c.WriteHierarchy().Root() == d.WriteBucket())
+		assertEqU64(t, c.ReadHierarchy().Leaf().Capacity(), 10)
+		assertEqU64(t, c.WriteHierarchy().Leaf().Capacity(), 20)
+		assertEqU64(t, uint64(d.Hosts()), 0)
+	})
+
+	t.Run("host buckets", func(t *testing.T) {
+		d := WrapDialer(&net.Dialer{})
+		d.SetCapacity(100)
+		d.SetHostCapacity(50)
+
+		conn1, err := d.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		conn2, err := d.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		assertEqU64(t, uint64(d.Hosts()), 1)
+
+		r1, r2 := conn1.(*Conn).ReadHierarchy().Root(), conn2.(*Conn).ReadHierarchy().Root()
+		assertTrue(t, r1 == r2)
+		assertTrue(t, r1.Parent() == d.ReadBucket())
+		assertEqU64(t, r1.Capacity(), 50)
+
+		assertNoErr(t, conn1.Close())
+		// the second close does not release the host again
+		_ = conn1.Close()
+		assertEqU64(t, uint64(d.Hosts()), 1)
+		assertNoErr(t, conn2.Close())
+		assertEqU64(t, uint64(d.Hosts()), 0)
+	})
+
+	t.Run("priority turns FIFO on", func(t *testing.T) {
+		d := WrapDialer(nil)
+		d.SetConnPriority(1)
+		assertTrue(t, d.ReadBucket().FIFO())
+		assertTrue(t, d.WriteBucket().FIFO())
+
+		d = WrapDialer(nil)
+		d.SetHostCapacity(50)
+		conn, err := d.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		defer conn.Close()
+
+		c := conn.(*Conn)
+		assertTrue(t, !c.ReadHierarchy().Root().FIFO())
+		c.SetPriority(1)
+		assertTrue(t, c.ReadHierarchy().Root().FIFO())
+		assertTrue(t, d.ReadBucket().FIFO())
+	})
+
+	t.Run("weight turns FIFO on", func(t *testing.T) {
+		d := WrapDialer(nil)
+		d.SetHostCapacity(50)
+
+		conn, err := d.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		defer conn.Close()
+
+		c := conn.(*Conn)
+		assertTrue(t, !d.ReadBucket().FIFO())
+		c.SetWeight(2)
+		assertTrue(t, d.ReadBucket().FIFO())
+		assertTrue(t, d.WriteBucket().FIFO())
+		assertTrue(t, c.ReadHierarchy().Root().FIFO())
+		assertTrue(t, c.WriteHierarchy().Root().FIFO())
+	})
+
+	t.Run("failed dial releases host", func(t *testing.T) {
+		d := WrapDialer(nil)
+		d.SetHostCapacity(50)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := d.DialContext(ctx, "tcp", ln.Addr().String())
+		assertTrue(t, err != nil)
+		assertEqU64(t, uint64(d.Hosts()), 0)
+	})
+}
@@ -0,0 +1,39 @@
+package throttle_test
+
+import (
+	"testing"
+	"time"
+)
+
+// helpers of the tests of the package from outside,
+// as of the helpers in bucket_test.go
+
+func assertEqU64(t *testing.T, val, expected uint64, msg ...interface{}) {
+	if val != expected {
+		t.Error(append([]interface{}{"assert uint64: ", val, "!=", expected}, msg...)...)
+	}
+}
+
+func assertTrue(t *testing.T, val bool, msg ...interface{}) {
+	if !val {
+		t.Error(append([]interface{}{"assert true"}, msg...)...)
+	}
+}
+
+func assertNoErr(t *testing.T, err error, msg ...interface{}) {
+	if err != nil {
+		t.Error(append([]interface{}{"assert no error: ", err}, msg...)...)
+	}
+}
+
+func assertErr(t *testing.T, err, expected error, msg ...interface{}) {
+	if err != expected {
+		t.Error(append([]interface{}{"assert error: ", err, "!=", expected}, msg...)...)
+	}
+}
+
+func assertEqDuration(t *testing.T, val, expected time.Duration, msg ...interface{}) {
+	if val != expected {
+		t.Error(append([]interface{}{"assert duration: ", val, "!=", expected}, msg...)...)
+	}
+}
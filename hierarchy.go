@@ -1,6 +1,14 @@
 package throttle
 
-// Hierarchy of buckets. 2 level.
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Hierarchy of buckets. It is a leaf bucket and the chain
+// of its ancestors: the root and the parents of the root,
+// see Bucket.SetParent. Any bucket of a tree can be a root.
 type Hierarchy struct {
 	leaf Bucket
 
@@ -17,17 +25,43 @@ type Hierarchy struct {
 	// a mutex or a channel queue for which the consumers
 	// are fighting, but the implementation uses the fact
 	// of preemptive goroutines scheduling being fair.
+	// A root in FIFO mode (see Bucket.SetFIFO) queues
+	// the consumers and serves them in arrival order.
 	//
 	// Fair queueing for the root bucket could use
 	// adaptive 1s window capacity adjusting (+/- 5%) to reduce
 	// overall bandwidth consumption error in a target window (X secs).
-	// For the best results it could benefit from knowing
-	// number and configuration of consumers at leafs. But even
-	// with the static number of scheduling units being
-	// an order of magnitude less than the overall capacity
-	// gives good results in a windows of 15-30s which
-	// is enough.
+	// For the best results it benefits from knowing
+	// number and configuration of consumers at leafs. So
+	// the root tracks the weight of the leaves actively
+	// consuming at it and splits the capacity between them.
+	//
+	// Under contention leaves share the root by weight. Every
+	// leaf gets a scheduling unit proportional to its weight.
+	// A root in FIFO mode serves waiting leaves round-robin,
+	// one unit per turn, so each leaf gets the share of the
+	// root proportional to its weight (weighted round-robin).
 	root *Bucket
+
+	weight uint64
+
+	// Under contention at ancestors in FIFO mode leaves
+	// of higher priority are served first.
+	priority int64
+
+	// Leaves can be classes as in Linux HTB. The leaf bucket
+	// is the ceil rate of the class, and the assured bucket is
+	// its guaranteed rate. The assured tokens are taken from the
+	// ancestors unconditionally, putting them into debt if
+	// needed, so the borrowers of unused bandwidth have to wait
+	// once the owner of it becomes active. The rest up to the
+	// ceil is borrowed from the ancestors as usual.
+	assured Bucket
+	// assured tokens of the last grant, Refund gives them
+	// back to the assured bucket first
+	owed uint64
+
+	stats counters
 }
 
 var _ Throttle = (*Hierarchy)(nil)
@@ -38,16 +72,197 @@ func NewHierarchy(root *Bucket) *Hierarchy {
 }
 
 // Consume consumes required bandwidth at local bucket first
-// and then requests the same from the parent. At parent level
-// consumers are up to the question of fair scheduling.
+// and then requests the same from the parents up to the top.
+// At parent level consumers are up to the question of fair
+// scheduling.
 func (h *Hierarchy) Consume(consume uint64) uint64 {
-	if h.root == nil || h.root.Unlimited() {
-		return h.leaf.Consume(consume)
+	consume, _ = h.ConsumeContext(context.Background(), consume)
+	return consume
+}
+
+// ConsumeContext is Consume which stops waiting when ctx is done.
+// If the wait at an ancestor is abandoned, tokens already taken
+// from the leaf and lower ancestors are given back to them.
+func (h *Hierarchy) ConsumeContext(ctx context.Context, consume uint64) (uint64, error) {
+	var requested = consume
+	var waited time.Duration
+	var weight = h.Weight()
+	for p := h.root; p != nil; p = p.parent {
+		atomic.AddUint64(&p.active, weight)
 	}
+	defer func() {
+		for p := h.root; p != nil; p = p.parent {
+			atomic.AddUint64(&p.active, ^(weight - 1))
+		}
+	}()
 
 	consume = h.Project(consume)
-	consume = h.leaf.Consume(consume)
-	return h.root.Consume(consume)
+	consume, waited, err := h.leaf.consume(ctx, consume, 0)
+	if err != nil {
+		h.stats.refuse(requested, waited)
+		return 0, err
+	}
+
+	var assured = h.assure(consume)
+	var borrow = consume - assured
+	if borrow == 0 {
+		atomic.StoreUint64(&h.owed, assured)
+		h.stats.consume(consume, waited)
+		return consume, nil
+	}
+
+	for p := h.root; p != nil; p = p.parent {
+		if p.Unlimited() {
+			continue
+		}
+		_, w, err := p.consume(ctx, borrow, h.Priority())
+		waited += w
+		if err != nil {
+			h.refundUpTo(p, borrow)
+			h.refundUpTo(nil, assured)
+			h.assured.Refund(assured)
+			h.stats.refuse(requested, waited)
+			return 0, err
+		}
+	}
+
+	atomic.StoreUint64(&h.owed, assured)
+	h.stats.consume(consume, waited)
+	return consume, nil
+}
+
+// assure takes up to consume tokens available at the assured
+// rate of the leaf and charges the ancestors for them without
+// waiting. It returns the number of the tokens taken.
+func (h *Hierarchy) assure(consume uint64) uint64 {
+	if h.assured.Unlimited() {
+		return 0
+	}
+
+	var assured = h.assured.TryConsumeUpTo(consume)
+	if assured == 0 {
+		return 0
+	}
+
+	for p := h.root; p != nil; p = p.parent {
+		var capacity, rate = p.limits()
+		if rate.unlimited() {
+			continue
+		}
+		p.reserve(capacity, rate, assured)
+	}
+
+	return assured
+}
+
+// TryConsume consumes exactly consume tokens at the leaf and
+// all of its ancestors if all of them have enough tokens right
+// now. It never blocks.
+func (h *Hierarchy) TryConsume(consume uint64) bool {
+	if !h.leaf.TryConsume(consume) {
+		atomic.AddUint64(&h.stats.refused, consume)
+		return false
+	}
+
+	for p := h.root; p != nil; p = p.parent {
+		if !p.TryConsume(consume) {
+			h.refundUpTo(p, consume)
+			atomic.AddUint64(&h.stats.refused, consume)
+			return false
+		}
+	}
+
+	atomic.StoreUint64(&h.owed, 0)
+	atomic.AddUint64(&h.stats.consumed, consume)
+	return true
+}
+
+// TryConsumeUpTo consumes as much tokens as the leaf and all of
+// its ancestors have right now but no more than consume. It never
+// blocks.
+func (h *Hierarchy) TryConsumeUpTo(consume uint64) uint64 {
+	var requested = consume
+	consume = h.leaf.TryConsumeUpTo(consume)
+
+	for p := h.root; p != nil && consume > 0; p = p.parent {
+		if n := p.TryConsumeUpTo(consume); n < consume {
+			h.refundUpTo(p, consume-n)
+			consume = n
+		}
+	}
+
+	atomic.StoreUint64(&h.owed, 0)
+	atomic.AddUint64(&h.stats.consumed, consume)
+	atomic.AddUint64(&h.stats.refused, requested-consume)
+	return consume
+}
+
+// Reserve takes consume tokens in advance at the leaf and all
+// of its ancestors. The reservation is available when all of
+// them have generated the tokens. It is not OK if consume
+// exceeds capacity of any of them.
+func (h *Hierarchy) Reserve(consume uint64) *Reservation {
+	var r = h.leaf.Reserve(consume)
+	if !r.ok {
+		atomic.AddUint64(&h.stats.refused, consume)
+		return r
+	}
+
+	for p := h.root; p != nil; p = p.parent {
+		var capacity, rate = p.limits()
+		if rate.unlimited() {
+			continue
+		}
+		if consume > capacity {
+			r.Cancel()
+			atomic.AddUint64(&h.stats.refused, consume)
+			return &Reservation{clock: r.clock, tokens: consume}
+		}
+
+		if at := p.reserve(capacity, rate, consume); at.After(r.at) {
+			r.at = at
+		}
+		r.buckets = append(r.buckets, p)
+	}
+
+	atomic.AddUint64(&h.stats.consumed, consume)
+	return r
+}
+
+// Refund gives back unused tokens to the leaf and all of its
+// ancestors. The tokens of the last grant taken at the assured
+// rate are given back to the assured rate first.
+func (h *Hierarchy) Refund(refund uint64) {
+	atomic.AddUint64(&h.stats.refunded, refund)
+	if assured := h.disown(refund); assured > 0 {
+		h.assured.Refund(assured)
+	}
+	h.refundUpTo(nil, refund)
+}
+
+// disown takes up to refund tokens off the assured part
+// of the last grant and returns their number.
+// forgive race condition for concurrent consumers.
+func (h *Hierarchy) disown(refund uint64) uint64 {
+	for {
+		var owed = atomic.LoadUint64(&h.owed)
+		var assured = owed
+		if assured > refund {
+			assured = refund
+		}
+		if assured == 0 || atomic.CompareAndSwapUint64(&h.owed, owed, owed-assured) {
+			return assured
+		}
+	}
+}
+
+// refundUpTo gives back tokens to the leaf and the ancestors
+// below the bucket top.
+func (h *Hierarchy) refundUpTo(top *Bucket, refund uint64) {
+	h.leaf.Refund(refund)
+	for p := h.root; p != nil && p != top; p = p.parent {
+		p.Refund(refund)
+	}
 }
 
 func (h *Hierarchy) SetCapacity(capacity uint64) {
@@ -56,26 +271,102 @@ func (h *Hierarchy) SetCapacity(capacity uint64) {
 
 func (h *Hierarchy) Reset() {
 	h.leaf.SetFill(0)
+	h.assured.SetFill(0)
+}
+
+// Assured returns the guaranteed rate of the leaf.
+func (h *Hierarchy) Assured() uint64 {
+	return h.assured.Rate()
+}
+
+// SetClass makes the leaf a class with the assured rate it is
+// guaranteed to get from the ancestors and the ceil rate it can
+// get at most by borrowing the unused bandwidth of the ancestors.
+// The assured rate of 0 means no guarantee. Only Consume and
+// ConsumeContext use the assured rate.
+func (h *Hierarchy) SetClass(assured, ceil uint64) {
+	h.assured.SetCapacity(assured)
+	h.leaf.SetCapacity(ceil)
 }
 
 // Project tries to give best estimate of the reservation
-// available for a single unit of scheduling at parent level.
+// available for a single unit of scheduling at parent levels.
 func (h *Hierarchy) Project(consume uint64) uint64 {
-	// static estimation - overall capacity split by 16, min 1
-	unit := h.root.Capacity() >> 4
-	if unit == 0 {
-		unit = 1
-	}
-	if consume > unit {
-		return unit
+	var weight = h.Weight()
+	for p := h.root; p != nil; p = p.parent {
+		if p.Unlimited() {
+			continue
+		}
+		// adaptive estimation - overall capacity split between
+		// active leaves by weight, within divisor limits scaled
+		// by weight for the ceiling, min 1
+		capacity := p.Capacity()
+		active := p.Active()
+		if active < weight {
+			active = weight
+		}
+		unit := mulDiv(capacity, weight, active, false)
+		min, max := p.UnitDivisor()
+		if max > 0 && unit < capacity/max {
+			unit = capacity / max
+		}
+		if ceil := mulDiv(capacity, weight, min, false); unit > ceil {
+			unit = ceil
+		}
+		if unit == 0 {
+			unit = 1
+		}
+		if consume > unit {
+			consume = unit
+		}
 	}
 	return consume
 }
 
+// Weight returns the share of the leaf at its ancestors
+// relative to other leaves. It is 1 by default.
+func (h *Hierarchy) Weight() uint64 {
+	if w := atomic.LoadUint64(&h.weight); w > 0 {
+		return w
+	}
+	return 1
+}
+
+// SetWeight sets the share of the leaf at its ancestors relative
+// to other leaves. Weights are honoured by ancestors in FIFO mode
+// (see Bucket.SetFIFO), in the polling mode leaves race for the
+// tokens. Conns turn it on at the buckets of their Listener or
+// Dialer, see Conn.SetWeight. The weight of 0 resets it to 1.
+func (h *Hierarchy) SetWeight(weight uint64) {
+	atomic.StoreUint64(&h.weight, weight)
+}
+
+// Priority returns the priority of the leaf at its ancestors.
+func (h *Hierarchy) Priority() int {
+	return int(atomic.LoadInt64(&h.priority))
+}
+
+// SetPriority sets the priority of the leaf at its ancestors. Leaves
+// of higher priority are always served first by ancestors in FIFO
+// mode (see Bucket.SetFIFO and Bucket.SetAging). Conns turn it on at
+// the buckets of their Listener or Dialer, see Conn.SetPriority.
+// It is 0 by default.
+func (h *Hierarchy) SetPriority(priority int) {
+	atomic.StoreInt64(&h.priority, int64(priority))
+}
+
+// SetClock sets the source of time of the leaf bucket.
+// The ancestors are shared and are configured by their owners.
+func (h *Hierarchy) SetClock(clock Clock) {
+	h.leaf.SetClock(clock)
+	h.assured.SetClock(clock)
+}
+
 func (h *Hierarchy) Leaf() *Bucket {
 	return &h.leaf
 }
 
+// Root returns the direct parent of the leaf.
 func (h *Hierarchy) Root() *Bucket {
 	return h.root
 }
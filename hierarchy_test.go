@@ -8,6 +8,264 @@ import (
 	"time"
 )
 
+func TestHierarchy_ConsumeContext(t *testing.T) {
+	t.Run("gives back leaf tokens if root wait is abandoned", func(t *testing.T) {
+		root := NewBucket(160)
+		root.SetUnitDivisor(16, 16)
+		h := NewHierarchy(root)
+		h.SetCapacity(100)
+
+		assertConsumeMax(t, root, 160, 160, time.Millisecond, "consume all root tokens first")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		n, err := h.ConsumeContext(ctx, 10)
+		assertEqU64(t, n, 0)
+		assertErr(t, err, context.DeadlineExceeded)
+		assertEqU64(t, h.Leaf().Fill(), 0)
+	})
+
+	t.Run("consumes at leaf and root", func(t *testing.T) {
+		root := NewBucket(160)
+		root.SetUnitDivisor(16, 16)
+		h := NewHierarchy(root)
+		h.SetCapacity(100)
+
+		n, err := h.ConsumeContext(context.Background(), 100)
+		assertEqU64(t, n, 10)
+		assertNoErr(t, err)
+		assertEqU64(t, h.Leaf().Fill(), 10)
+		assertEqU64(t, root.Fill(), 10)
+	})
+}
+
+func TestHierarchy_TryConsume(t *testing.T) {
+	t.Run("checks leaf and root together", func(t *testing.T) {
+		root := NewBucket(160)
+		root.SetUnitDivisor(16, 16)
+		h := NewHierarchy(root)
+		h.SetCapacity(100)
+
+		assertTrue(t, h.TryConsume(100))
+		assertTrue(t, !h.TryConsume(1), "leaf is empty")
+		assertEqU64(t, root.Fill(), 100)
+
+		h.Reset()
+		assertTrue(t, !h.TryConsume(70), "root is short")
+		assertEqU64(t, h.Leaf().Fill(), 0)
+		assertEqU64(t, root.Fill(), 100)
+	})
+
+	t.Run("up to the least available", func(t *testing.T) {
+		root := NewBucket(160)
+		root.SetUnitDivisor(16, 16)
+		h := NewHierarchy(root)
+		h.SetCapacity(100)
+
+		assertEqU64(t, root.TryConsumeUpTo(130), 130)
+		assertEqU64(t, h.TryConsumeUpTo(50), 30)
+		assertEqU64(t, h.Leaf().Fill(), 30)
+		assertEqU64(t, root.Fill(), 160)
+		assertEqU64(t, h.TryConsumeUpTo(50), 0)
+		assertEqU64(t, h.Leaf().Fill(), 30)
+	})
+}
+
+func TestHierarchy_Refund(t *testing.T) {
+	root := NewBucket(160)
+	root.SetUnitDivisor(16, 16)
+	h := NewHierarchy(root)
+	h.SetCapacity(100)
+
+	assertEqU64(t, h.Consume(100), 10)
+	h.Refund(4)
+	assertEqU64(t, h.Leaf().Fill(), 6)
+	assertEqU64(t, root.Fill(), 6)
+}
+
+func TestHierarchy_Project(t *testing.T) {
+	t.Run("1/16 of capacity by default", func(t *testing.T) {
+		root := NewBucket(16000)
+		h := NewHierarchy(root)
+		assertEqU64(t, h.Project(100000), 1000)
+		h.SetWeight(3)
+		assertEqU64(t, h.Project(100000), 3000)
+	})
+
+	t.Run("whole capacity for the only leaf", func(t *testing.T) {
+		root := NewBucket(16000)
+		root.SetUnitDivisor(1, 0)
+		h := NewHierarchy(root)
+		assertEqU64(t, h.Project(100000), 16000)
+		h.SetWeight(3)
+		assertEqU64(t, h.Project(100000), 16000)
+	})
+
+	t.Run("capacity split between active leaves by weight", func(t *testing.T) {
+		root := NewBucket(16000)
+		root.SetUnitDivisor(1, 0)
+		h := NewHierarchy(root)
+		root.active = 4
+		assertEqU64(t, h.Project(100000), 4000)
+		h.SetWeight(3)
+		assertEqU64(t, h.Project(100000), 12000)
+		assertEqU64(t, h.Project(100), 100)
+	})
+
+	t.Run("divisor limits", func(t *testing.T) {
+		root := NewBucket(16000)
+		h := NewHierarchy(root)
+
+		root.active = 100
+		assertEqU64(t, h.Project(100000), 160)
+		root.SetUnitDivisor(1, 16)
+		assertEqU64(t, h.Project(100000), 1000, "floor")
+
+		root.active = 1
+		root.SetUnitDivisor(4, 0)
+		assertEqU64(t, h.Project(100000), 4000, "ceiling")
+	})
+
+	t.Run("tracks active leaves", func(t *testing.T) {
+		root := NewBucket(16000)
+		root.SetUnitDivisor(16, 16)
+		h := NewHierarchy(root)
+		h.SetWeight(3)
+
+		assertEqU64(t, root.Consume(16000), 16000)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			_, _ = h.ConsumeContext(ctx, 1000)
+			close(done)
+		}()
+		for root.Active() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		assertEqU64(t, root.Active(), 3)
+		cancel()
+		<-done
+		assertEqU64(t, root.Active(), 0)
+	})
+}
+
+func TestHierarchy_Arrival(t *testing.T) {
+	t.Run("late leaf is not held back in polling mode", func(t *testing.T) {
+		root := NewBucket(16000)
+		assertEqU64(t, root.Consume(16000), 16000)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		// the first leaf waits alone when the second one comes
+		early := NewHierarchy(root)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				n, err := early.ConsumeContext(ctx, 1<<20)
+				if err != nil {
+					return
+				}
+				assertTrue(t, n <= 1000, "early leaf got", n)
+			}
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		late := NewHierarchy(root)
+		start := time.Now()
+		n, err := late.ConsumeContext(ctx, 1<<20)
+		assertNoErr(t, err)
+		assertEqU64(t, n, 1000)
+		assertTrue(t, time.Since(start) < 250*time.Millisecond, "late leaf waited", time.Since(start))
+		cancel()
+		<-done
+	})
+}
+
+func TestHierarchy_Tree(t *testing.T) {
+	newTree := func() (*Bucket, *Bucket, *Hierarchy) {
+		top := NewBucket(160)
+		top.SetUnitDivisor(16, 16)
+		mid := NewBucket(1600)
+		mid.SetParent(top)
+		h := NewHierarchy(mid)
+		h.SetCapacity(1000)
+		return top, mid, h
+	}
+
+	t.Run("consumes at all ancestors", func(t *testing.T) {
+		top, mid, h := newTree()
+
+		assertEqU64(t, h.Consume(1000), 10, "projected by the top")
+		assertEqU64(t, h.Leaf().Fill(), 10)
+		assertEqU64(t, mid.Fill(), 10)
+		assertEqU64(t, top.Fill(), 10)
+
+		h.Refund(10)
+		assertEqU64(t, h.Leaf().Fill(), 0)
+		assertEqU64(t, mid.Fill(), 0)
+		assertEqU64(t, top.Fill(), 0)
+	})
+
+	t.Run("gives back tokens if top wait is abandoned", func(t *testing.T) {
+		top, mid, h := newTree()
+		assertEqU64(t, top.Consume(160), 160)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		n, err := h.ConsumeContext(ctx, 10)
+		assertEqU64(t, n, 0)
+		assertErr(t, err, context.DeadlineExceeded)
+		assertEqU64(t, h.Leaf().Fill(), 0)
+		assertEqU64(t, mid.Fill(), 0)
+		assertEqU64(t, top.Fill(), 160)
+	})
+
+	t.Run("try consume checks all ancestors", func(t *testing.T) {
+		top, mid, h := newTree()
+		assertEqU64(t, top.Consume(150), 150)
+
+		assertTrue(t, !h.TryConsume(20))
+		assertEqU64(t, h.Leaf().Fill(), 0)
+		assertEqU64(t, mid.Fill(), 0)
+
+		assertEqU64(t, h.TryConsumeUpTo(20), 10)
+		assertEqU64(t, h.Leaf().Fill(), 10)
+		assertEqU64(t, mid.Fill(), 10)
+		assertEqU64(t, top.Fill(), 160)
+	})
+
+	t.Run("reserves at all ancestors", func(t *testing.T) {
+		top, mid, h := newTree()
+
+		r := h.Reserve(100)
+		assertTrue(t, r.OK())
+		assertEqU64(t, top.Fill(), 100)
+		r.Cancel()
+		assertEqU64(t, h.Leaf().Fill(), 0)
+		assertEqU64(t, mid.Fill(), 0)
+		assertEqU64(t, top.Fill(), 0)
+
+		assertTrue(t, !h.Reserve(200).OK(), "exceeds the top")
+		assertEqU64(t, h.Leaf().Fill(), 0)
+		assertEqU64(t, mid.Fill(), 0)
+	})
+
+	t.Run("parent cycle", func(t *testing.T) {
+		top, mid, _ := newTree()
+		defer func() {
+			if recover() == nil {
+				t.Error("cycle is not detected")
+			}
+		}()
+		top.SetParent(mid)
+	})
+}
+
 func TestHierarchy(t *testing.T) {
 	t.Run("test only overall root bandwidth reads", func(t *testing.T) {
 		t.Parallel()
@@ -91,7 +349,7 @@ func TestHierarchy(t *testing.T) {
 		const bufSize = 10000
 
 		ts := NewTestSystem(t)
-		overallRead := NewMeasureBandwidth(t, bandwidth/2, "overall_halfed_read")
+		overallRead := NewMeasureBandwidth(t, bandwidth, "overall_read")
 		ts.StartListener(func(ctx context.Context, id uint64, conn net.Conn) {
 			var buf = make([]byte, bufSize)
 			var stat = NewMeasureBandwidth(t, bandwidth, "read")
@@ -192,7 +450,7 @@ func TestHierarchy(t *testing.T) {
 		const bufSize = 10000
 
 		ts := NewTestSystem(t)
-		overallRead := NewMeasureBandwidth(t, bandwidth/2, "overall_halfed_read")
+		overallRead := NewMeasureBandwidth(t, bandwidth, "overall_read")
 		ts.StartListener(func(ctx context.Context, id uint64, conn net.Conn) {
 			var buf = make([]byte, bufSize)
 			var stat = NewMeasureBandwidth(t, bandwidth, "read")
@@ -0,0 +1,192 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Reader throttles reads of an io.Reader. A throttle can
+// be shared between readers and writers to limit them all
+// together.
+type Reader struct {
+	ctx context.Context
+	r   io.Reader
+	t   Throttle
+}
+
+var _ io.Reader = (*Reader)(nil)
+
+func NewReader(r io.Reader, t Throttle) *Reader {
+	return NewReaderContext(context.Background(), r, t)
+}
+
+// NewReaderContext returns a reader which stops waiting
+// for the bandwidth when ctx is done.
+func NewReaderContext(ctx context.Context, r io.Reader, t Throttle) *Reader {
+	return &Reader{ctx: ctx, r: r, t: t}
+}
+
+func (r *Reader) Read(b []byte) (n int, err error) {
+	return read(r.ctx, r.t, r.r, b)
+}
+
+// Writer throttles writes of an io.Writer.
+type Writer struct {
+	ctx context.Context
+	w   io.Writer
+	t   Throttle
+}
+
+var _ io.Writer = (*Writer)(nil)
+
+func NewWriter(w io.Writer, t Throttle) *Writer {
+	return NewWriterContext(context.Background(), w, t)
+}
+
+// NewWriterContext returns a writer which stops waiting
+// for the bandwidth when ctx is done.
+func NewWriterContext(ctx context.Context, w io.Writer, t Throttle) *Writer {
+	return &Writer{ctx: ctx, w: w, t: t}
+}
+
+func (w *Writer) Write(b []byte) (n int, err error) {
+	return write(w.ctx, w.t, w.w, b)
+}
+
+// ReadWriteCloser throttles reads and writes of an
+// io.ReadWriteCloser by the same throttle.
+type ReadWriteCloser struct {
+	Reader
+	Writer
+
+	c io.Closer
+}
+
+var _ io.ReadWriteCloser = (*ReadWriteCloser)(nil)
+
+func NewReadWriteCloser(rwc io.ReadWriteCloser, t Throttle) *ReadWriteCloser {
+	return NewReadWriteCloserContext(context.Background(), rwc, t)
+}
+
+// NewReadWriteCloserContext returns a read write closer which
+// stops waiting for the bandwidth when ctx is done.
+func NewReadWriteCloserContext(ctx context.Context, rwc io.ReadWriteCloser, t Throttle) *ReadWriteCloser {
+	return &ReadWriteCloser{
+		Reader: Reader{ctx: ctx, r: rwc, t: t},
+		Writer: Writer{ctx: ctx, w: rwc, t: t},
+		c:      rwc,
+	}
+}
+
+func (rwc *ReadWriteCloser) Close() error {
+	return rwc.c.Close()
+}
+
+// read can't peek utilization of the read buffer
+// in advance. So doing our best we are just consuming
+// min(len(b), capacity) from the throttle and
+// refunding what was not read.
+func read(ctx context.Context, t Throttle, r io.Reader, b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	// reserved = min(len(b), capacity)
+	// as there is no sense to wait more than a sec
+	// not knowing read buf utilization.
+	//
+	// so do the best effort and configure size of
+	// recv buf knowing your throttled bandwidth
+	// and application level traffic pattern.
+	reserved, err := t.ConsumeContext(ctx, uint64(len(b)))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err = r.Read(b[:reserved])
+	if uint64(n) < reserved {
+		t.Refund(reserved - uint64(n))
+	}
+	return n, err
+}
+
+// write naively throttles amount of write. It could
+// try to push first available tokens as soon as it could,
+// but not this time. If ctx is done while waiting for
+// the bandwidth, it returns the number of bytes written
+// so far.
+func write(ctx context.Context, t Throttle, w io.Writer, b []byte) (n int, err error) {
+	var n2 int
+
+	for len(b) > 0 {
+		reserved, err := t.ConsumeContext(ctx, uint64(len(b)))
+		if err != nil {
+			return n, err
+		}
+		if reserved == 0 {
+			return n, errors.New("consumed 0 requested " + strconv.Itoa(len(b)))
+		}
+
+		n2, err = w.Write(b[:reserved])
+		n += n2
+		if err != nil {
+			return n, err
+		}
+
+		b = b[reserved:]
+	}
+
+	return n, err
+}
+
+// copyChunks copies from src to dst until io.EOF in chunks of
+// the bandwidth available at t. Each chunk is copied with
+// io.CopyN, so dst implementing io.ReaderFrom (e.g. *net.TCPConn)
+// keeps its zero-copy path (splice, sendfile) for it. As of read
+// it waits for the tokens before it can tell there is nothing
+// left to copy and refunds the unused ones.
+func copyChunks(ctx context.Context, t Throttle, dst io.Writer, src io.Reader) (n int64, err error) {
+	// io.CopyN limits src itself, so unwrap the limit of src
+	// to keep the reader dst expects visible (conn to conn
+	// copy of two throttled conns)
+	var limit *io.LimitedReader
+	if lr, ok := src.(*io.LimitedReader); ok {
+		limit, src = lr, lr.R
+	}
+
+	for {
+		var want int64 = math.MaxInt64
+		if limit != nil {
+			if limit.N <= 0 {
+				return n, nil
+			}
+			want = limit.N
+		}
+
+		reserved, err := t.ConsumeContext(ctx, uint64(want))
+		if err != nil {
+			return n, err
+		}
+		if reserved == 0 {
+			return n, errors.New("consumed 0 requested " + strconv.FormatInt(want, 10))
+		}
+
+		copied, err := io.CopyN(dst, src, int64(reserved))
+		n += copied
+		if limit != nil {
+			limit.N -= copied
+		}
+		if uint64(copied) < reserved {
+			t.Refund(reserved - uint64(copied))
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
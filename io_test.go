@@ -0,0 +1,142 @@
+package throttle_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sitano/throttle"
+	"github.com/sitano/throttle/throttletest"
+)
+
+func TestReader(t *testing.T) {
+	t.Run("refunds unread tokens", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(100)
+		b.SetClock(c)
+
+		r := throttle.NewReader(strings.NewReader("hello"), b)
+		n, err := r.Read(make([]byte, 100))
+		assertNoErr(t, err)
+		assertEqU64(t, uint64(n), 5)
+		assertEqU64(t, b.Fill(), 5)
+	})
+
+	t.Run("reads at the rate", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+
+		done := make(chan []byte)
+		go func() {
+			data, _ := ioutil.ReadAll(throttle.NewReader(strings.NewReader(strings.Repeat("x", 25)), b))
+			done <- data
+		}()
+
+		// 10 + 10 + 5 bytes and the last read waits
+		// for the tokens to get io.EOF
+		for i := 0; i < 3; i++ {
+			c.BlockUntil(1)
+			c.Advance(time.Second)
+		}
+		assertEqU64(t, uint64(len(<-done)), 25)
+	})
+
+	t.Run("context", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+		assertEqU64(t, b.Consume(10), 10)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		r := throttle.NewReaderContext(ctx, strings.NewReader("hello"), b)
+		n, err := r.Read(make([]byte, 5))
+		assertErr(t, err, context.Canceled)
+		assertEqU64(t, uint64(n), 0)
+	})
+}
+
+func TestWriter(t *testing.T) {
+	t.Run("writes in chunks at the rate", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+
+		var buf bytes.Buffer
+		done := make(chan int)
+		go func() {
+			n, _ := throttle.NewWriter(&buf, b).Write(make([]byte, 30))
+			done <- n
+		}()
+
+		for i := 0; i < 2; i++ {
+			c.BlockUntil(1)
+			c.Advance(time.Second)
+		}
+		assertEqU64(t, uint64(<-done), 30)
+		assertEqU64(t, uint64(buf.Len()), 30)
+	})
+
+	t.Run("context reports partial write", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var buf bytes.Buffer
+		type result struct {
+			n   int
+			err error
+		}
+		done := make(chan result)
+		go func() {
+			n, err := throttle.NewWriterContext(ctx, &buf, b).Write(make([]byte, 30))
+			done <- result{n, err}
+		}()
+
+		c.BlockUntil(1)
+		cancel()
+		r := <-done
+		assertErr(t, r.err, context.Canceled)
+		assertEqU64(t, uint64(r.n), 10)
+		assertEqU64(t, uint64(buf.Len()), 10)
+	})
+}
+
+type readWriteCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (rwc *readWriteCloser) Close() error {
+	rwc.closed = true
+	return nil
+}
+
+func TestReadWriteCloser(t *testing.T) {
+	t.Run("reads and writes share the throttle", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(100)
+		b.SetClock(c)
+
+		var buf readWriteCloser
+		rwc := throttle.NewReadWriteCloser(&buf, b)
+
+		n, err := rwc.Write(make([]byte, 30))
+		assertNoErr(t, err)
+		assertEqU64(t, uint64(n), 30)
+
+		n, err = rwc.Read(make([]byte, 50))
+		assertNoErr(t, err)
+		assertEqU64(t, uint64(n), 30)
+		assertEqU64(t, b.Fill(), 60)
+
+		assertNoErr(t, rwc.Close())
+		assertTrue(t, buf.closed)
+	})
+}
@@ -1,7 +1,11 @@
 package throttle
 
+import "context"
+
 type Throttle interface {
 	Consume(consume uint64) uint64
+	ConsumeContext(ctx context.Context, consume uint64) (uint64, error)
+	Refund(refund uint64)
 }
 
 type Capacity interface {
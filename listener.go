@@ -1,43 +1,273 @@
 package throttle
 
 import (
+	"context"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Listener implements throttled net.Listener which
 // return throttled connections. Connections have
-// 2-level bucket hierarchy.
+// 2-level bucket hierarchy per direction. Optionally
+// connections from the same source share source buckets
+// between them and the server class (see SetSourceCapacity).
 type Listener struct {
 	l net.Listener
 
-	// server class bucket
-	b Bucket
+	// server class buckets
+	rb Bucket // ingress
+	wb Bucket // egress
 
 	// bandwidth per incoming connection
-	connBandwidth uint64
+	connRead  uint64
+	connWrite uint64
+	// guaranteed bandwidth per incoming connection
+	connAssured uint64
+	// priority of incoming connections
+	connPriority int64
+
+	// bandwidth per source, 0 means no source buckets
+	srcRead  uint64
+	srcWrite uint64
+	// source prefix length of IPv4 and IPv6 addresses,
+	// 0 means the whole address
+	srcPrefix4 int64
+	srcPrefix6 int64
+	// idle sources timeout in ns, 0 means evict right away
+	srcIdle int64
+
+	// accept rate of the server class
+	ab Bucket
+	// accept rate and burst per source
+	srcAccept      uint64
+	srcAcceptBurst uint64
+	// max live connections of the server class and
+	// per source, 0 means no limit
+	maxConns    int64
+	srcMaxConns int64
+	// reject connections over the limits, 0 or 1
+	reject uint32
+	// apply conn settings to live connections, 0 or 1
+	live uint32
+
+	// closed is done when the listener is closed
+	closed context.Context
+	close  context.CancelFunc
+
+	// admitted connections and accept errors handed to Accept
+	// by the accept loop and the sources, see serve
+	serving sync.Once
+	// the accept loop is started, 0 or 1
+	started uint32
+	ready   chan accepted
+	// stopped is closed when the accept loop stops with err
+	stopped chan struct{}
+	err     error
+
+	mu      sync.Mutex
+	sources map[string]*source
+	// last time sources were checked for eviction in ns
+	evicted int64
+	// number of live connections
+	conns int
+	// number of accepted and rejected connections
+	accepted uint64
+	rejected uint64
+	// counters of the closed connections
+	closedStats ConnStats
+	// live connections, see Conns
+	registry map[*Conn]struct{}
+	// freed is signalled when a connection is closed
+	freed *sync.Cond
+	// onReject is called before closing a rejected connection
+	onReject func(net.Conn)
+	// classifier chooses classes of connections
+	classifier Classifier
+}
+
+// accepted is an admitted connection or an accept error.
+type accepted struct {
+	conn *Conn
+	err  error
 }
 
 var _ net.Listener = (*Listener)(nil)
 var _ Capacity = (*Listener)(nil)
 
 func WrapListener(listener net.Listener) *Listener {
-	return &Listener{
-		l: listener,
+	var l = &Listener{
+		l:        listener,
+		sources:  make(map[string]*source),
+		srcIdle:  int64(DefaultSourceIdleTimeout),
+		registry: make(map[*Conn]struct{}),
+		ready:    make(chan accepted),
+		stopped:  make(chan struct{}),
 	}
+	l.freed = sync.NewCond(&l.mu)
+	l.closed, l.close = context.WithCancel(context.Background())
+	return l
 }
 
+// Accept waits for the next connection within the accept
+// limits (see SetAcceptRate and SetMaxConns). Connections
+// over the limits are delayed or rejected, see SetReject.
+//
+// Connections are accepted by a loop started by the first
+// Accept, so one connection may wait in the loop for the
+// next Accept, or more of them being classified, see
+// SetClassifier.
 func (l *Listener) Accept() (net.Conn, error) {
-	conn, err := l.l.Accept()
-	if err != nil {
-		return nil, err
+	l.serving.Do(func() {
+		atomic.StoreUint32(&l.started, 1)
+		go l.serve()
+	})
+
+	select {
+	case a := <-l.ready:
+		if a.err != nil {
+			return nil, a.err
+		}
+		return a.conn, nil
+	case <-l.stopped:
+		return nil, l.err
+	}
+}
+
+// serve accepts connections and hands the admitted ones to
+// Accept until the listener fails. Connections over the limits
+// of the server class are kept in the backlog in delay mode,
+// while connections over the source limits are parked with
+// the source (see admit), so they never stall the loop.
+func (l *Listener) serve() {
+	// backoff of temporary accept errors, e.g. too many open
+	// files, as of net/http
+	var delay time.Duration
+	for {
+		if !l.Reject() {
+			if err := l.waitConns(); err != nil {
+				l.stop(err)
+				return
+			}
+			if _, err := l.ab.ConsumeContext(l.closed, 1); err != nil {
+				l.stop(net.ErrClosed)
+				return
+			}
+		}
+
+		conn, err := l.l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				l.deliverError(err)
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				l.sleep(delay)
+				continue
+			}
+			l.stop(err)
+			return
+		}
+		delay = 0
+
+		if src, ok := l.admit(conn); ok {
+			l.handOff(conn, src)
+		}
+	}
+}
+
+// handOff wraps the admitted conn and hands it to Accept.
+// Classifiers may wait for the conn (see SetClassifier), so
+// they run off the accept loop.
+func (l *Listener) handOff(conn net.Conn, src *source) {
+	if l.Classifier() == nil {
+		l.deliver(l.wrap(conn, src))
+		return
+	}
+	go func() {
+		l.deliver(l.wrap(conn, src))
+	}()
+}
+
+// deliver hands the admitted conn to Accept. It closes
+// the conn if the listener is closed.
+func (l *Listener) deliver(c *Conn) {
+	select {
+	case l.ready <- accepted{conn: c}:
+	case <-l.closed.Done():
+		_ = c.Close()
+	}
+}
+
+// sleep waits for d or until the listener is closed.
+func (l *Listener) sleep(d time.Duration) {
+	var t = time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-l.closed.Done():
+	}
+}
+
+// deliverError hands the temporary accept error to Accept.
+func (l *Listener) deliverError(err error) {
+	select {
+	case l.ready <- accepted{err: err}:
+	case <-l.closed.Done():
+	}
+}
+
+// beforeAccept panics if the accept loop is started already, as
+// the settings of the buckets it reads are not guarded.
+func (l *Listener) beforeAccept(name string) {
+	if atomic.LoadUint32(&l.started) == 1 {
+		panic("throttle: Listener." + name + " after Accept")
+	}
+}
+
+// stop makes Accept return err from now on.
+func (l *Listener) stop(err error) {
+	l.err = err
+	close(l.stopped)
+}
+
+// wrap returns the admitted conn throttled according
+// to its class, see SetClassifier.
+func (l *Listener) wrap(conn net.Conn, src *source) *Conn {
+	var class = l.classify(conn, src)
+
+	wrap := WrapConnWithParents(class.Conn, class.ReadParent, class.WriteParent)
+	wrap.SetClock(l.rb.Clock())
+	wrap.SetReadClass(class.Assured, class.ReadCapacity)
+	wrap.SetWriteClass(class.Assured, class.WriteCapacity)
+	if src != nil {
+		wrap.queue = queueAt(wrap, &l.rb, &l.wb, &src.rb, &src.wb)
+	} else {
+		wrap.queue = queueAt(wrap, &l.rb, &l.wb)
+	}
+	wrap.SetPriority(class.Priority)
+	wrap.SetWeight(class.Weight)
+	wrap.onClose = func() {
+		l.closeConn(wrap, src)
 	}
-	wrap := WrapConnWithParent(conn, &l.b)
-	wrap.SetCapacity(atomic.LoadUint64(&l.connBandwidth))
-	return wrap, nil
+	l.register(wrap)
+	return wrap
 }
 
+// Close closes the listener. Accept waiting for the limits
+// returns net.ErrClosed. Accepted connections stay open.
 func (l *Listener) Close() error {
+	l.close()
+	l.mu.Lock()
+	l.freed.Broadcast()
+	l.mu.Unlock()
 	return l.l.Close()
 }
 
@@ -45,16 +275,113 @@ func (l *Listener) Addr() net.Addr {
 	return l.l.Addr()
 }
 
+// SetCapacity sets both the read and the write capacity
+// of the server class.
 func (l *Listener) SetCapacity(capacity uint64) {
-	l.b.SetCapacity(capacity)
+	l.SetReadCapacity(capacity)
+	l.SetWriteCapacity(capacity)
+}
+
+func (l *Listener) SetReadCapacity(capacity uint64) {
+	l.rb.SetCapacity(capacity)
 	// forgive race condition for concurrent sets
-	l.b.SetFill(capacity)
+	l.rb.SetFill(capacity)
+}
+
+func (l *Listener) SetWriteCapacity(capacity uint64) {
+	l.wb.SetCapacity(capacity)
+	// forgive race condition for concurrent sets
+	l.wb.SetFill(capacity)
 }
 
 func (l *Listener) Reset() {
-	l.b.SetFill(0)
+	l.rb.SetFill(0)
+	l.wb.SetFill(0)
 }
 
+// SetConnCapacity sets both the read and the write
+// capacity of incoming connections. It applies to the
+// live connections too if live updates are on, see
+// SetLiveUpdate.
 func (l *Listener) SetConnCapacity(capacity uint64) {
-	atomic.StoreUint64(&l.connBandwidth, capacity)
+	l.SetConnReadCapacity(capacity)
+	l.SetConnWriteCapacity(capacity)
+}
+
+func (l *Listener) SetConnReadCapacity(capacity uint64) {
+	atomic.StoreUint64(&l.connRead, capacity)
+	l.update(func(c *Conn) {
+		c.r.SetCapacity(capacity)
+	})
+}
+
+func (l *Listener) SetConnWriteCapacity(capacity uint64) {
+	atomic.StoreUint64(&l.connWrite, capacity)
+	l.update(func(c *Conn) {
+		c.w.SetCapacity(capacity)
+	})
+}
+
+// SetConnClass sets the assured and the ceil bandwidth of
+// incoming connections in both directions, see Hierarchy.SetClass.
+func (l *Listener) SetConnClass(assured, ceil uint64) {
+	atomic.StoreUint64(&l.connAssured, assured)
+	atomic.StoreUint64(&l.connRead, ceil)
+	atomic.StoreUint64(&l.connWrite, ceil)
+	l.update(func(c *Conn) {
+		c.r.SetClass(assured, ceil)
+		c.w.SetClass(assured, ceil)
+	})
+}
+
+// SetConnPriority sets the priority of incoming connections at
+// the server class buckets. The priority of an accepted connection
+// can be changed with Conn.SetPriority. The server class buckets
+// turn FIFO mode on for non-zero priorities, see SetFIFO.
+func (l *Listener) SetConnPriority(priority int) {
+	if priority != 0 {
+		l.SetFIFO(true)
+	}
+	atomic.StoreInt64(&l.connPriority, int64(priority))
+	l.update(func(c *Conn) {
+		c.SetPriority(priority)
+	})
+}
+
+// SetFIFO makes the server class buckets serve connections
+// in the order of priority and arrival, see Bucket.SetFIFO.
+func (l *Listener) SetFIFO(fifo bool) {
+	l.rb.SetFIFO(fifo)
+	l.wb.SetFIFO(fifo)
+}
+
+// SetParent attaches the server class buckets to a parent
+// in a tree of buckets. It must be set before the first
+// Accept, it panics otherwise.
+func (l *Listener) SetParent(parent *Bucket) {
+	l.beforeAccept("SetParent")
+	l.rb.SetParent(parent)
+	l.wb.SetParent(parent)
+}
+
+// ReadBucket returns the server class bucket of reads.
+// It can be a parent for other buckets.
+func (l *Listener) ReadBucket() *Bucket {
+	return &l.rb
+}
+
+// WriteBucket returns the server class bucket of writes.
+// It can be a parent for other buckets.
+func (l *Listener) WriteBucket() *Bucket {
+	return &l.wb
+}
+
+// SetClock sets the source of time of the server class buckets
+// and of the accepted connections. It must be set before the
+// first Accept, it panics otherwise.
+func (l *Listener) SetClock(clock Clock) {
+	l.beforeAccept("SetClock")
+	l.rb.SetClock(clock)
+	l.wb.SetClock(clock)
+	l.ab.SetClock(clock)
 }
@@ -0,0 +1,134 @@
+package throttle
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// tempError is a temporary accept error, e.g. too many open files.
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// flakyListener fails the first Accept calls with tempError
+// and records the time of each call.
+type flakyListener struct {
+	net.Listener
+	fails int
+	calls chan time.Time
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	select {
+	case l.calls <- time.Now():
+	default:
+	}
+	if l.fails > 0 {
+		l.fails--
+		return nil, tempError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestListener_Configure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	wrap := WrapListener(ln)
+	wrap.SetClock(SystemClock)
+	wrap.SetParent(NewBucket(100))
+	assertNoErr(t, wrap.Close())
+	_, err = wrap.Accept()
+	assertTrue(t, err != nil)
+
+	assertPanics := func(name string, fn func()) {
+		defer func() {
+			assertTrue(t, recover() != nil, name, "does not panic after Accept")
+		}()
+		fn()
+	}
+	assertPanics("SetClock", func() {
+		wrap.SetClock(SystemClock)
+	})
+	assertPanics("SetParent", func() {
+		wrap.SetParent(nil)
+	})
+}
+
+func TestListener_Priority(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	wrap := WrapListener(ln)
+	defer wrap.Close()
+	wrap.SetFIFO(false)
+	assertTrue(t, !wrap.ReadBucket().FIFO())
+	wrap.SetConnPriority(1)
+	assertTrue(t, wrap.ReadBucket().FIFO())
+	assertTrue(t, wrap.WriteBucket().FIFO())
+}
+
+func TestListener_Weight(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	wrap := WrapListener(ln)
+	defer wrap.Close()
+	wrap.SetClassifier(func(conn net.Conn) Class {
+		return Class{Weight: 2}
+	})
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("net.Dial:", err)
+	}
+	defer client.Close()
+	conn, err := wrap.Accept()
+	if err != nil {
+		t.Fatal("accept:", err)
+	}
+	defer conn.Close()
+
+	assertEqU64(t, conn.(*Conn).ReadHierarchy().Weight(), 2)
+	assertTrue(t, wrap.ReadBucket().FIFO())
+	assertTrue(t, wrap.WriteBucket().FIFO())
+}
+
+func TestListener_TemporaryError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	flaky := &flakyListener{Listener: ln, fails: 3, calls: make(chan time.Time, 4)}
+	wrap := WrapListener(flaky)
+	defer wrap.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := wrap.Accept()
+		ne, ok := err.(net.Error)
+		assertTrue(t, ok && ne.Temporary(), "accept:", err)
+	}
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("net.Dial:", err)
+	}
+	defer client.Close()
+	conn, err := wrap.Accept()
+	assertNoErr(t, err)
+	assertNoErr(t, conn.Close())
+
+	// retries back off 5ms, 10ms, 20ms
+	prev := <-flaky.calls
+	for i := 0; i < 3; i++ {
+		next := <-flaky.calls
+		assertTrue(t, next.Sub(prev) >= 5*time.Millisecond<<i, "retry", i, "after", next.Sub(prev))
+		prev = next
+	}
+}
@@ -0,0 +1,489 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PacketConn throttles net.PacketConn reads and writes
+// by bytes, by packets or both. Every remote address (peer)
+// gets its own leaves under the server class buckets per
+// direction. Peers idle for longer than the idle timeout
+// are forgotten.
+//
+// Incoming datagrams over the budget are delayed by default,
+// or dropped (see SetDrop). Outgoing datagrams are always
+// delayed.
+type PacketConn struct {
+	c net.PacketConn
+
+	// closed is done when the conn is closed
+	closed context.Context
+	close  context.CancelFunc
+
+	// server class buckets of bytes
+	rb Bucket // ingress
+	wb Bucket // egress
+	// server class buckets of packets
+	rp Bucket // ingress
+	wp Bucket // egress
+
+	mu    sync.Mutex
+	peers map[string]*peer
+	// last time peers were checked for eviction in ns
+	evicted int64
+	// datagrams read but not delivered by the read deadline
+	// in the order of arrival, guarded by mu
+	held []datagram
+
+	// bandwidth per peer
+	peerRead  uint64
+	peerWrite uint64
+	// packet rate per peer
+	peerReadPackets  uint64
+	peerWritePackets uint64
+
+	// drop incoming datagrams over the budget, 0 or 1
+	drop uint32
+	// peers idle timeout in ns, 0 means never evict
+	idle int64
+
+	// deadlines in unix ns, 0 means no deadline
+	rdl int64
+	wdl int64
+}
+
+// peer is the throttling state of a remote address.
+type peer struct {
+	r  Hierarchy // ingress bytes
+	w  Hierarchy // egress bytes
+	rp Hierarchy // ingress packets
+	wp Hierarchy // egress packets
+
+	// number of operations in progress,
+	// guarded by PacketConn.mu
+	refs int
+	// last activity in ns, guarded by PacketConn.mu
+	seen int64
+}
+
+// datagram is a copy of a read datagram.
+type datagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+var errMissingAddress = errors.New("missing address")
+
+var _ net.PacketConn = (*PacketConn)(nil)
+var _ Capacity = (*PacketConn)(nil)
+
+// DefaultPeerIdleTimeout is the time after which idle peers
+// of a PacketConn are evicted by default.
+const DefaultPeerIdleTimeout = time.Minute
+
+func WrapPacketConn(c net.PacketConn) *PacketConn {
+	var conn = &PacketConn{
+		c:     c,
+		peers: make(map[string]*peer),
+		idle:  int64(DefaultPeerIdleTimeout),
+	}
+	conn.closed, conn.close = context.WithCancel(context.Background())
+	return conn
+}
+
+// ReadFrom reads a datagram and charges its peer for it. If the
+// peer or the server class is over the budget, the datagram is
+// either delivered once the budget allows or dropped and the next
+// one is read. A delayed datagram not delivered by the read deadline
+// is kept and returned by the next ReadFrom first.
+func (c *PacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		if d, ok := c.unhold(); ok {
+			n, addr = copy(b, d.b), d.addr
+		} else {
+			n, addr, err = c.c.ReadFrom(b)
+			if err != nil || addr == nil {
+				return n, addr, err
+			}
+		}
+
+		var p = c.acquire(addr)
+		if c.Drop() {
+			var ok = tryConsumeDatagram(&p.r, &p.rp, uint64(n))
+			c.release(p)
+			if ok {
+				return n, addr, nil
+			}
+			continue
+		}
+
+		ctx, cancel := deadlineContext(c.closed, atomic.LoadInt64(&c.rdl))
+		err = consumeDatagram(ctx, &p.r, &p.rp, uint64(n))
+		cancel()
+		c.release(p)
+		if err != nil {
+			c.hold(b[:n], addr)
+			return 0, nil, throttleError(err)
+		}
+		return n, addr, nil
+	}
+}
+
+// hold keeps a copy of the datagram for the next ReadFrom.
+func (c *PacketConn) hold(b []byte, addr net.Addr) {
+	var d = datagram{b: append([]byte(nil), b...), addr: addr}
+
+	c.mu.Lock()
+	c.held = append(c.held, d)
+	c.mu.Unlock()
+}
+
+// unhold returns the first datagram kept by hold, if any.
+func (c *PacketConn) unhold() (datagram, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.held) == 0 {
+		return datagram{}, false
+	}
+	var d = c.held[0]
+	c.held[0] = datagram{}
+	c.held = c.held[1:]
+	return d, true
+}
+
+// WriteTo waits for the budget of the peer and of the server
+// class and writes the datagram.
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	if addr == nil {
+		return 0, &net.OpError{Op: "write", Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Err: errMissingAddress}
+	}
+
+	var p = c.acquire(addr)
+
+	ctx, cancel := deadlineContext(c.closed, atomic.LoadInt64(&c.wdl))
+	err = consumeDatagram(ctx, &p.w, &p.wp, uint64(len(b)))
+	cancel()
+	c.release(p)
+	if err != nil {
+		return 0, throttleError(err)
+	}
+
+	return c.c.WriteTo(b, addr)
+}
+
+// consumeDatagram takes exactly n bytes and a packet from
+// the hierarchies. It gives back what it took on error.
+func consumeDatagram(ctx context.Context, bytes, packets *Hierarchy, n uint64) error {
+	if _, err := packets.ConsumeContext(ctx, 1); err != nil {
+		return err
+	}
+
+	// a datagram can be larger than the capacity
+	// of the buckets, it takes it in parts then
+	var consumed uint64
+	for consumed < n {
+		chunk, err := bytes.ConsumeContext(ctx, n-consumed)
+		if err == nil && chunk == 0 {
+			err = errors.New("consumed 0 requested " + strconv.FormatUint(n-consumed, 10))
+		}
+		if err != nil {
+			bytes.Refund(consumed)
+			packets.Refund(1)
+			return err
+		}
+		consumed += chunk
+	}
+
+	return nil
+}
+
+// tryConsumeDatagram takes n bytes and a packet from the
+// hierarchies if all of them are available right now.
+func tryConsumeDatagram(bytes, packets *Hierarchy, n uint64) bool {
+	if !packets.TryConsume(1) {
+		return false
+	}
+	if !tryConsumeBytes(bytes, n) {
+		packets.Refund(1)
+		return false
+	}
+	return true
+}
+
+// tryConsumeBytes takes n bytes from the hierarchy if they are
+// available right now. As of delay mode, a datagram larger than
+// the capacity of the buckets is taken in parts: the whole
+// capacity once it is available and the rest in debt, so the
+// following datagrams wait for it to be paid.
+func tryConsumeBytes(h *Hierarchy, n uint64) bool {
+	var limit = n
+	if capacity, rate := h.leaf.limits(); !rate.unlimited() && capacity < limit {
+		limit = capacity
+	}
+	for p := h.root; p != nil; p = p.parent {
+		if capacity, rate := p.limits(); !rate.unlimited() && capacity < limit {
+			limit = capacity
+		}
+	}
+
+	if !h.TryConsume(limit) {
+		return false
+	}
+	if debt := n - limit; debt > 0 {
+		if capacity, rate := h.leaf.limits(); !rate.unlimited() {
+			h.leaf.reserve(capacity, rate, debt)
+		}
+		for p := h.root; p != nil; p = p.parent {
+			if capacity, rate := p.limits(); !rate.unlimited() {
+				p.reserve(capacity, rate, debt)
+			}
+		}
+		atomic.AddUint64(&h.stats.consumed, debt)
+	}
+	return true
+}
+
+// acquire returns the peer of the address and holds it from
+// eviction until release.
+func (c *PacketConn) acquire(addr net.Addr) *peer {
+	var key = addr.Network() + "/" + addr.String()
+	var now = c.rb.Clock().Now().UnixNano()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evict(now)
+
+	p, ok := c.peers[key]
+	if !ok {
+		p = c.newPeer()
+		c.peers[key] = p
+	}
+	p.refs++
+	p.seen = now
+	return p
+}
+
+func (c *PacketConn) release(p *peer) {
+	var now = c.rb.Clock().Now().UnixNano()
+
+	c.mu.Lock()
+	p.refs--
+	p.seen = now
+	c.mu.Unlock()
+}
+
+// evict forgets the peers idle for longer than the idle timeout.
+// It scans the peers at most once per the timeout. It must be
+// called under the lock.
+func (c *PacketConn) evict(now int64) {
+	var idle = atomic.LoadInt64(&c.idle)
+	if idle <= 0 || now-c.evicted < idle {
+		return
+	}
+	c.evicted = now
+
+	for key, p := range c.peers {
+		if p.refs == 0 && now-p.seen >= idle {
+			delete(c.peers, key)
+		}
+	}
+}
+
+func (c *PacketConn) newPeer() *peer {
+	var p = &peer{
+		r:  *NewHierarchy(&c.rb),
+		w:  *NewHierarchy(&c.wb),
+		rp: *NewHierarchy(&c.rp),
+		wp: *NewHierarchy(&c.wp),
+	}
+
+	var clock = c.rb.Clock()
+	p.r.SetClock(clock)
+	p.w.SetClock(clock)
+	p.rp.SetClock(clock)
+	p.wp.SetClock(clock)
+
+	p.r.SetCapacity(atomic.LoadUint64(&c.peerRead))
+	p.w.SetCapacity(atomic.LoadUint64(&c.peerWrite))
+	p.rp.SetCapacity(atomic.LoadUint64(&c.peerReadPackets))
+	p.wp.SetCapacity(atomic.LoadUint64(&c.peerWritePackets))
+	return p
+}
+
+// Peers returns the number of the remote addresses
+// the conn keeps limits for.
+func (c *PacketConn) Peers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.peers)
+}
+
+// Close closes the conn. Reads and writes waiting for the
+// bandwidth return net.ErrClosed.
+func (c *PacketConn) Close() error {
+	c.close()
+	return c.c.Close()
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.c.LocalAddr()
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	atomic.StoreInt64(&c.rdl, deadlineNano(t))
+	atomic.StoreInt64(&c.wdl, deadlineNano(t))
+	return c.c.SetDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	atomic.StoreInt64(&c.rdl, deadlineNano(t))
+	return c.c.SetReadDeadline(t)
+}
+
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	atomic.StoreInt64(&c.wdl, deadlineNano(t))
+	return c.c.SetWriteDeadline(t)
+}
+
+// SetCapacity sets both the read and the write bandwidth
+// of the server class in bytes.
+func (c *PacketConn) SetCapacity(capacity uint64) {
+	c.SetReadCapacity(capacity)
+	c.SetWriteCapacity(capacity)
+}
+
+func (c *PacketConn) SetReadCapacity(capacity uint64) {
+	c.rb.SetCapacity(capacity)
+}
+
+func (c *PacketConn) SetWriteCapacity(capacity uint64) {
+	c.wb.SetCapacity(capacity)
+}
+
+// SetPacketRate sets both the read and the write rate
+// of the server class in packets.
+func (c *PacketConn) SetPacketRate(packets uint64) {
+	c.SetReadPacketRate(packets)
+	c.SetWritePacketRate(packets)
+}
+
+func (c *PacketConn) SetReadPacketRate(packets uint64) {
+	c.rp.SetCapacity(packets)
+}
+
+func (c *PacketConn) SetWritePacketRate(packets uint64) {
+	c.wp.SetCapacity(packets)
+}
+
+func (c *PacketConn) Reset() {
+	c.rb.SetFill(0)
+	c.wb.SetFill(0)
+	c.rp.SetFill(0)
+	c.wp.SetFill(0)
+}
+
+// SetPeerCapacity sets both the read and the write bandwidth
+// of the peers in bytes. It applies to new peers.
+func (c *PacketConn) SetPeerCapacity(capacity uint64) {
+	c.SetPeerReadCapacity(capacity)
+	c.SetPeerWriteCapacity(capacity)
+}
+
+func (c *PacketConn) SetPeerReadCapacity(capacity uint64) {
+	atomic.StoreUint64(&c.peerRead, capacity)
+}
+
+func (c *PacketConn) SetPeerWriteCapacity(capacity uint64) {
+	atomic.StoreUint64(&c.peerWrite, capacity)
+}
+
+// SetPeerPacketRate sets both the read and the write rate
+// of the peers in packets. It applies to new peers.
+func (c *PacketConn) SetPeerPacketRate(packets uint64) {
+	c.SetPeerReadPacketRate(packets)
+	c.SetPeerWritePacketRate(packets)
+}
+
+func (c *PacketConn) SetPeerReadPacketRate(packets uint64) {
+	atomic.StoreUint64(&c.peerReadPackets, packets)
+}
+
+func (c *PacketConn) SetPeerWritePacketRate(packets uint64) {
+	atomic.StoreUint64(&c.peerWritePackets, packets)
+}
+
+// Drop returns whether incoming datagrams over the budget
+// are dropped instead of delayed.
+func (c *PacketConn) Drop() bool {
+	return atomic.LoadUint32(&c.drop) == 1
+}
+
+// SetDrop makes the conn drop incoming datagrams over the
+// budget instead of delaying them.
+func (c *PacketConn) SetDrop(drop bool) {
+	var v uint32
+	if drop {
+		v = 1
+	}
+	atomic.StoreUint32(&c.drop, v)
+}
+
+// SetIdleTimeout sets the time after which idle peers are
+// forgotten. The timeout of 0 keeps them forever.
+func (c *PacketConn) SetIdleTimeout(d time.Duration) {
+	atomic.StoreInt64(&c.idle, int64(d))
+}
+
+// SetFIFO makes the server class buckets serve peers
+// in the order of arrival, see Bucket.SetFIFO.
+func (c *PacketConn) SetFIFO(fifo bool) {
+	c.rb.SetFIFO(fifo)
+	c.wb.SetFIFO(fifo)
+	c.rp.SetFIFO(fifo)
+	c.wp.SetFIFO(fifo)
+}
+
+// SetParent attaches the server class buckets of bytes
+// to a parent in a tree of buckets. It must be set before
+// the conn is used.
+func (c *PacketConn) SetParent(parent *Bucket) {
+	c.rb.SetParent(parent)
+	c.wb.SetParent(parent)
+}
+
+// ReadBucket returns the server class bucket of read bytes.
+func (c *PacketConn) ReadBucket() *Bucket {
+	return &c.rb
+}
+
+// WriteBucket returns the server class bucket of written bytes.
+func (c *PacketConn) WriteBucket() *Bucket {
+	return &c.wb
+}
+
+// ReadPacketBucket returns the server class bucket of read packets.
+func (c *PacketConn) ReadPacketBucket() *Bucket {
+	return &c.rp
+}
+
+// WritePacketBucket returns the server class bucket of written packets.
+func (c *PacketConn) WritePacketBucket() *Bucket {
+	return &c.wp
+}
+
+// SetClock sets the source of time of the server class buckets
+// and of the peers. It must be set before the conn is used.
+func (c *PacketConn) SetClock(clock Clock) {
+	c.rb.SetClock(clock)
+	c.wb.SetClock(clock)
+	c.rp.SetClock(clock)
+	c.wp.SetClock(clock)
+}
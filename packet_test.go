@@ -0,0 +1,239 @@
+package throttle_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sitano/throttle"
+	"github.com/sitano/throttle/throttletest"
+)
+
+// listenPacket returns throttled udp server conn on loopback
+// using the clock.
+func listenPacket(t *testing.T, c *throttletest.Clock) *throttle.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.ListenPacket:", err)
+	}
+	conn := throttle.WrapPacketConn(pc)
+	conn.SetClock(c)
+	return conn
+}
+
+// sendPackets sends n datagrams of size bytes to the addr
+// from a new client and returns the client.
+func sendPackets(t *testing.T, addr net.Addr, n, size int) net.Conn {
+	client, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal("net.Dial:", err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := client.Write(make([]byte, size)); err != nil {
+			t.Fatal("write:", err)
+		}
+	}
+	return client
+}
+
+// readPackets reads datagrams until no more come in.
+func readPackets(t *testing.T, conn *throttle.PacketConn) (packets int) {
+	buf := make([]byte, 1500)
+	for {
+		assertNoErr(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Error("read:", err)
+			}
+			return packets
+		}
+		packets++
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	t.Run("drops datagrams over the peer budget", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		conn := listenPacket(t, c)
+		defer conn.Close()
+		conn.SetDrop(true)
+		conn.SetPeerReadPacketRate(2)
+
+		client := sendPackets(t, conn.LocalAddr(), 5, 10)
+		defer client.Close()
+
+		assertEqU64(t, uint64(readPackets(t, conn)), 2)
+		assertEqU64(t, uint64(conn.Peers()), 1)
+	})
+
+	t.Run("drops datagrams over the bytes budget", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		conn := listenPacket(t, c)
+		defer conn.Close()
+		conn.SetDrop(true)
+		conn.SetReadCapacity(100)
+
+		client := sendPackets(t, conn.LocalAddr(), 5, 40)
+		defer client.Close()
+
+		assertEqU64(t, uint64(readPackets(t, conn)), 2)
+	})
+
+	t.Run("takes datagrams larger than the capacity in debt", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		conn := listenPacket(t, c)
+		defer conn.Close()
+		conn.SetDrop(true)
+		conn.SetReadCapacity(1000)
+		conn.Reset()
+
+		client := sendPackets(t, conn.LocalAddr(), 3, 1400)
+		defer client.Close()
+		assertEqU64(t, uint64(readPackets(t, conn)), 1)
+		assertEqU64(t, conn.ReadBucket().Fill(), 1400)
+
+		// the debt is paid
+		c.Advance(1400 * time.Millisecond)
+		client2 := sendPackets(t, conn.LocalAddr(), 2, 1400)
+		defer client2.Close()
+		assertEqU64(t, uint64(readPackets(t, conn)), 1)
+	})
+
+	t.Run("peers have own budgets", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		conn := listenPacket(t, c)
+		defer conn.Close()
+		conn.SetDrop(true)
+		conn.SetPeerReadPacketRate(1)
+
+		client1 := sendPackets(t, conn.LocalAddr(), 3, 10)
+		defer client1.Close()
+		client2 := sendPackets(t, conn.LocalAddr(), 3, 10)
+		defer client2.Close()
+
+		assertEqU64(t, uint64(readPackets(t, conn)), 2)
+		assertEqU64(t, uint64(conn.Peers()), 2)
+	})
+
+	t.Run("delays datagrams over the budget", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		conn := listenPacket(t, c)
+		defer conn.Close()
+		conn.SetPeerReadPacketRate(1)
+
+		client := sendPackets(t, conn.LocalAddr(), 2, 10)
+		defer client.Close()
+
+		buf := make([]byte, 1500)
+		n, _, err := conn.ReadFrom(buf)
+		assertNoErr(t, err)
+		assertEqU64(t, uint64(n), 10)
+
+		done := make(chan error)
+		go func() {
+			_, _, err := conn.ReadFrom(buf)
+			done <- err
+		}()
+		c.BlockUntil(1)
+		c.Advance(time.Second)
+		assertNoErr(t, <-done)
+	})
+
+	t.Run("keeps delayed datagram past the read deadline", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		conn := listenPacket(t, c)
+		defer conn.Close()
+		conn.SetPeerReadPacketRate(1)
+
+		client := sendPackets(t, conn.LocalAddr(), 2, 10)
+		defer client.Close()
+
+		buf := make([]byte, 1500)
+		_, _, err := conn.ReadFrom(buf)
+		assertNoErr(t, err)
+
+		assertNoErr(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		_, _, err = conn.ReadFrom(buf)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("read:", err)
+		}
+
+		assertNoErr(t, conn.SetReadDeadline(time.Time{}))
+		type read struct {
+			n    int
+			addr net.Addr
+			err  error
+		}
+		done := make(chan read)
+		go func() {
+			n, addr, err := conn.ReadFrom(buf)
+			done <- read{n, addr, err}
+		}()
+		c.BlockUntil(1)
+		c.Advance(time.Second)
+		r := <-done
+		assertNoErr(t, r.err)
+		assertEqU64(t, uint64(r.n), 10)
+		assertTrue(t, r.addr.String() == client.LocalAddr().String(), r.addr)
+	})
+
+	t.Run("write without address", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		conn := listenPacket(t, c)
+		defer conn.Close()
+
+		_, err := conn.WriteTo(make([]byte, 10), nil)
+		assertTrue(t, err != nil)
+		assertEqU64(t, uint64(conn.Peers()), 0)
+	})
+
+	t.Run("writes wait for the budget", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		conn := listenPacket(t, c)
+		defer conn.Close()
+		conn.SetPeerWriteCapacity(10)
+
+		sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("net.ListenPacket:", err)
+		}
+		defer sink.Close()
+
+		done := make(chan int)
+		go func() {
+			n, err := conn.WriteTo(make([]byte, 30), sink.LocalAddr())
+			assertNoErr(t, err)
+			done <- n
+		}()
+		for i := 0; i < 2; i++ {
+			c.BlockUntil(1)
+			c.Advance(time.Second)
+		}
+		assertEqU64(t, uint64(<-done), 30)
+
+		n, _, err := sink.ReadFrom(make([]byte, 1500))
+		assertNoErr(t, err)
+		assertEqU64(t, uint64(n), 30)
+	})
+
+	t.Run("evicts idle peers", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		conn := listenPacket(t, c)
+		defer conn.Close()
+		conn.SetIdleTimeout(time.Minute)
+
+		client1 := sendPackets(t, conn.LocalAddr(), 1, 10)
+		defer client1.Close()
+		assertEqU64(t, uint64(readPackets(t, conn)), 1)
+		assertEqU64(t, uint64(conn.Peers()), 1)
+
+		c.Advance(2 * time.Minute)
+
+		client2 := sendPackets(t, conn.LocalAddr(), 1, 10)
+		defer client2.Close()
+		assertEqU64(t, uint64(readPackets(t, conn)), 1)
+		assertEqU64(t, uint64(conn.Peers()), 1)
+	})
+}
@@ -0,0 +1,110 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// waitQueue hands out a turn to wait for the tokens to
+// the consumers in the order of their priority and then
+// in the order they have come. Only the consumer holding
+// the turn polls the bucket, others sleep until the turn
+// is passed to them. A turn in progress is not preempted.
+type waitQueue struct {
+	mu      sync.Mutex
+	busy    bool
+	waiters []*waiter
+
+	// waiting for aging raises the priority by 1
+	aging time.Duration
+}
+
+type waiter struct {
+	ready    chan struct{}
+	priority int
+	since    time.Time
+}
+
+// acquire blocks until it is the turn of the caller
+// or ctx is done. It reports whether the caller has
+// been queued.
+func (q *waitQueue) acquire(ctx context.Context, priority int, now time.Time) (bool, error) {
+	q.mu.Lock()
+	if !q.busy {
+		q.busy = true
+		q.mu.Unlock()
+		return false, nil
+	}
+
+	var w = &waiter{ready: make(chan struct{}), priority: priority, since: now}
+	q.waiters = append(q.waiters, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return true, nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	for i, x := range q.waiters {
+		if x == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			q.mu.Unlock()
+			return true, ctx.Err()
+		}
+	}
+	q.mu.Unlock()
+
+	// the turn has been passed to us already, pass it on
+	q.release(now)
+	return true, ctx.Err()
+}
+
+// release passes the turn to the next waiter.
+func (q *waitQueue) release(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiters) == 0 {
+		q.busy = false
+		return
+	}
+
+	// waiters are in the order of arrival, so the first
+	// one of the highest priority is the next
+	var next, best = 0, q.priority(q.waiters[0], now)
+	for i := 1; i < len(q.waiters); i++ {
+		if p := q.priority(q.waiters[i], now); p > best {
+			next, best = i, p
+		}
+	}
+
+	var w = q.waiters[next]
+	copy(q.waiters[next:], q.waiters[next+1:])
+	q.waiters[len(q.waiters)-1] = nil
+	q.waiters = q.waiters[:len(q.waiters)-1]
+	close(w.ready)
+}
+
+// priority returns the priority of the waiter raised by aging.
+func (q *waitQueue) priority(w *waiter, now time.Time) int {
+	if q.aging <= 0 {
+		return w.priority
+	}
+	return w.priority + int(now.Sub(w.since)/q.aging)
+}
+
+// len returns the number of consumers waiting for the turn.
+func (q *waitQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiters)
+}
+
+func (q *waitQueue) setAging(aging time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.aging = aging
+}
@@ -0,0 +1,299 @@
+package throttle_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sitano/throttle"
+	"github.com/sitano/throttle/throttletest"
+)
+
+func TestBucket_FIFO(t *testing.T) {
+	t.Run("serves waiters in arrival order", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+		b.SetFIFO(true)
+
+		assertEqU64(t, b.Consume(10), 10)
+
+		order := make(chan int, 3)
+		for i := 0; i < 3; i++ {
+			go func(i int) {
+				b.Consume(10)
+				order <- i
+			}(i)
+			// make sure they arrive in order
+			for b.Waiting() < i {
+				time.Sleep(time.Millisecond)
+			}
+			c.BlockUntil(1)
+		}
+
+		for i := 0; i < 3; i++ {
+			c.BlockUntil(1)
+			c.Advance(time.Second)
+			if got := <-order; got != i {
+				t.Error("served", got, "!=", i)
+			}
+		}
+	})
+
+	t.Run("abandoned waiter leaves the queue", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+		b.SetFIFO(true)
+
+		assertEqU64(t, b.Consume(10), 10)
+
+		done := make(chan uint64)
+		go func() {
+			done <- b.Consume(10)
+		}()
+		c.BlockUntil(1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error)
+		go func() {
+			_, err := b.ConsumeContext(ctx, 10)
+			errs <- err
+		}()
+		for b.Waiting() < 1 {
+			time.Sleep(time.Millisecond)
+		}
+
+		cancel()
+		assertErr(t, <-errs, context.Canceled)
+		assertEqU64(t, uint64(b.Waiting()), 0)
+
+		c.Advance(time.Second)
+		assertEqU64(t, <-done, 10)
+	})
+
+	t.Run("fairness", func(t *testing.T) {
+		const consumers = 10
+		const chunk = 100
+		const steps = 1000
+
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10000)
+		b.SetClock(c)
+		b.SetFIFO(true)
+		assertEqU64(t, b.Consume(10000), 10000)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		var consumed [consumers]uint64
+		for i := 0; i < consumers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for {
+					n, err := b.ConsumeContext(ctx, chunk)
+					if err != nil {
+						return
+					}
+					consumed[i] += n
+				}
+			}(i)
+		}
+
+		for i := 0; i < steps; i++ {
+			// wait for all of them to come back to the queue
+			for b.Waiting() < consumers-1 {
+				time.Sleep(time.Microsecond)
+			}
+			c.BlockUntil(1)
+			c.Advance(10 * time.Millisecond)
+		}
+		cancel()
+		wg.Wait()
+
+		var total uint64
+		for _, n := range consumed {
+			total += n
+		}
+		mean := float64(total) / consumers
+
+		var deviation float64
+		for _, n := range consumed {
+			d := (float64(n) - mean) / mean
+			if d < 0 {
+				d = -d
+			}
+			if d > deviation {
+				deviation = d
+			}
+		}
+
+		t.Log("total =", total, "mean =", mean, "max deviation =", deviation, "per consumer =", consumed)
+		if deviation > 0.05 {
+			t.Error("unfair distribution: max deviation =", deviation, "per consumer =", consumed)
+		}
+	})
+}
+
+func TestHierarchy_Weight(t *testing.T) {
+	t.Run("throughput converges to weights", func(t *testing.T) {
+		const warmup = 20
+		const steps = 2000
+
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		root := throttle.NewBucket(16000)
+		root.SetClock(c)
+		root.SetFIFO(true)
+		assertEqU64(t, root.Consume(16000), 16000)
+
+		weights := []uint64{3, 1}
+		consumed := make([]uint64, len(weights))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		for i, w := range weights {
+			h := throttle.NewHierarchy(root)
+			h.SetClock(c)
+			h.SetWeight(w)
+
+			wg.Add(1)
+			go func(i int, h *throttle.Hierarchy) {
+				defer wg.Done()
+				for {
+					n, err := h.ConsumeContext(ctx, 1<<20)
+					if err != nil {
+						return
+					}
+					atomic.AddUint64(&consumed[i], n)
+				}
+			}(i, h)
+		}
+
+		// skip turns taken before all leaves became active
+		var start = make([]uint64, len(weights))
+		for i := 0; i < warmup+steps; i++ {
+			if i == warmup {
+				for j := range start {
+					start[j] = atomic.LoadUint64(&consumed[j])
+				}
+			}
+			for root.Waiting() < len(weights)-1 {
+				time.Sleep(time.Microsecond)
+			}
+			c.BlockUntil(1)
+			c.Advance(100 * time.Millisecond)
+		}
+		cancel()
+		wg.Wait()
+
+		for j := range consumed {
+			consumed[j] -= start[j]
+		}
+		ratio := float64(consumed[0]) / float64(consumed[1])
+		t.Log("consumed =", consumed, "ratio =", ratio)
+		if ratio < 2.9 || ratio > 3.1 {
+			t.Error("throughput ratio", ratio, "does not converge to weights", weights, "consumed =", consumed)
+		}
+	})
+}
+
+func TestHierarchy_Priority(t *testing.T) {
+	// serve starts a consumer of the root with the priority and
+	// waits for it to queue up
+	serve := func(c *throttletest.Clock, root *throttle.Bucket, priority int, order chan<- int) {
+		h := throttle.NewHierarchy(root)
+		h.SetClock(c)
+		h.SetPriority(priority)
+
+		waiting := root.Waiting()
+		go func() {
+			h.Consume(10)
+			order <- priority
+		}()
+		for root.Waiting() <= waiting {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("higher priority first", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		root := throttle.NewBucket(10)
+		root.SetClock(c)
+		root.SetFIFO(true)
+		root.SetUnitDivisor(1, 1)
+		assertEqU64(t, root.Consume(10), 10)
+
+		order := make(chan int, 4)
+		go func() {
+			root.Consume(10)
+			order <- -1
+		}()
+		c.BlockUntil(1)
+
+		serve(c, root, 0, order)
+		serve(c, root, 1, order)
+		serve(c, root, 2, order)
+
+		for _, expected := range []int{-1, 2, 1, 0} {
+			c.BlockUntil(1)
+			c.Advance(time.Second)
+			if got := <-order; got != expected {
+				t.Error("served", got, "!=", expected)
+			}
+		}
+	})
+
+	t.Run("priority keeps polling mode", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		root := throttle.NewBucket(10)
+		root.SetClock(c)
+		root.SetUnitDivisor(1, 1)
+		assertEqU64(t, root.Consume(10), 10)
+
+		done := make(chan uint64)
+		h := throttle.NewHierarchy(root)
+		h.SetClock(c)
+		h.SetPriority(1)
+		go func() {
+			done <- h.Consume(10)
+		}()
+		c.BlockUntil(1)
+		assertTrue(t, !root.FIFO())
+		assertEqU64(t, uint64(root.Waiting()), 0)
+
+		c.Advance(time.Second)
+		assertEqU64(t, <-done, 10)
+		assertTrue(t, !root.FIFO())
+	})
+
+	t.Run("aging", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		root := throttle.NewBucket(10)
+		root.SetClock(c)
+		root.SetFIFO(true)
+		root.SetUnitDivisor(1, 1)
+		root.SetAging(100 * time.Millisecond)
+		assertEqU64(t, root.Consume(10), 10)
+
+		order := make(chan int, 3)
+		go func() {
+			root.Consume(10)
+			order <- -1
+		}()
+		c.BlockUntil(1)
+
+		serve(c, root, 0, order)
+		c.Advance(500 * time.Millisecond)
+		serve(c, root, 3, order)
+
+		for _, expected := range []int{-1, 0, 3} {
+			c.BlockUntil(1)
+			c.Advance(time.Second)
+			if got := <-order; got != expected {
+				t.Error("served", got, "!=", expected)
+			}
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package throttle
+
+import "sync/atomic"
+
+// register adds the accepted conn to the live connections.
+func (l *Listener) register(c *Conn) {
+	l.mu.Lock()
+	l.registry[c] = struct{}{}
+	l.mu.Unlock()
+}
+
+// update applies the change of the conn settings to the live
+// connections if live updates are on, see SetLiveUpdate.
+func (l *Listener) update(fn func(c *Conn)) {
+	if !l.LiveUpdate() {
+		return
+	}
+	l.ForEachConn(func(c *Conn) bool {
+		fn(c)
+		return true
+	})
+}
+
+// Conns returns the live connections accepted by the listener.
+func (l *Listener) Conns() []*Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var conns = make([]*Conn, 0, len(l.registry))
+	for c := range l.registry {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// ForEachConn calls fn for every live connection accepted by
+// the listener until fn returns false. Connections accepted
+// or closed meanwhile may be missed or visited.
+func (l *Listener) ForEachConn(fn func(c *Conn) bool) {
+	for _, c := range l.Conns() {
+		if !fn(c) {
+			return
+		}
+	}
+}
+
+// LookupConn returns the live connection with the remote
+// address or nil if there is none.
+func (l *Listener) LookupConn(remote string) *Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for c := range l.registry {
+		if c.RemoteAddr().String() == remote {
+			return c
+		}
+	}
+	return nil
+}
+
+// LiveUpdate reports whether the changes of the connection
+// settings apply to the live connections.
+func (l *Listener) LiveUpdate() bool {
+	return atomic.LoadUint32(&l.live) == 1
+}
+
+// SetLiveUpdate makes SetConnCapacity, SetConnReadCapacity,
+// SetConnWriteCapacity, SetConnClass and SetConnPriority apply
+// to the live connections as well, overriding their classes
+// (see SetClassifier). By default they apply to connections
+// accepted afterwards.
+func (l *Listener) SetLiveUpdate(live bool) {
+	var v uint32
+	if live {
+		v = 1
+	}
+	atomic.StoreUint32(&l.live, v)
+}
@@ -0,0 +1,71 @@
+package throttle
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListener_Registry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	wrap := WrapListener(ln)
+	defer wrap.Close()
+	wrap.SetConnCapacity(10)
+
+	var clients []net.Conn
+	var conns []*Conn
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("net.Dial:", err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+
+		conn, err := wrap.Accept()
+		if err != nil {
+			t.Fatal("accept:", err)
+		}
+		conns = append(conns, conn.(*Conn))
+	}
+
+	assertEqU64(t, uint64(len(wrap.Conns())), 2)
+	assertTrue(t, wrap.LookupConn(clients[1].LocalAddr().String()) == conns[1])
+	assertTrue(t, wrap.LookupConn("127.0.0.1:1") == nil)
+
+	var visited int
+	wrap.ForEachConn(func(c *Conn) bool {
+		visited++
+		return false
+	})
+	assertEqU64(t, uint64(visited), 1)
+
+	// new connections only
+	wrap.SetConnWriteCapacity(20)
+	for _, c := range conns {
+		assertEqU64(t, c.WriteHierarchy().Leaf().Capacity(), 10)
+	}
+
+	wrap.SetLiveUpdate(true)
+	wrap.SetConnReadCapacity(30)
+	wrap.SetConnPriority(2)
+	for _, c := range conns {
+		assertEqU64(t, c.ReadHierarchy().Leaf().Capacity(), 30)
+		assertEqU64(t, c.WriteHierarchy().Leaf().Capacity(), 10)
+		assertEqU64(t, uint64(c.ReadHierarchy().Priority()), 2)
+	}
+
+	wrap.SetConnClass(5, 50)
+	for _, c := range conns {
+		assertEqU64(t, c.ReadHierarchy().Assured(), 5)
+		assertEqU64(t, c.WriteHierarchy().Leaf().Capacity(), 50)
+	}
+
+	assertNoErr(t, conns[0].Close())
+	assertEqU64(t, uint64(len(wrap.Conns())), 1)
+	assertTrue(t, wrap.Conns()[0] == conns[1])
+	assertNoErr(t, conns[1].Close())
+	assertEqU64(t, uint64(len(wrap.Conns())), 0)
+}
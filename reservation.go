@@ -0,0 +1,85 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrCapacityExceeded is returned by Reservation.Wait when
+// the reservation asked for more tokens than the capacity.
+var ErrCapacityExceeded = errors.New("throttle: reservation exceeds capacity")
+
+// Reservation holds tokens taken in advance by Reserve
+// until they are available. It is either waited for
+// or cancelled.
+type Reservation struct {
+	ok     bool
+	tokens uint64
+	at     time.Time
+	clock  Clock
+
+	// buckets the tokens were taken from
+	buckets []*Bucket
+
+	// set once the reservation is waited for or cancelled
+	done uint32
+}
+
+// OK reports whether the tokens could be reserved at all.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Tokens returns the number of tokens reserved.
+func (r *Reservation) Tokens() uint64 {
+	return r.tokens
+}
+
+// Delay returns how long it takes for the reserved
+// tokens to become available. It is 0 when they are
+// available already.
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return 0
+	}
+	if d := r.at.Sub(r.clock.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Cancel gives the reserved tokens back to the buckets they
+// were taken from. It does nothing if the reservation has been
+// waited for successfully or cancelled before.
+func (r *Reservation) Cancel() {
+	if !r.ok || !atomic.CompareAndSwapUint32(&r.done, 0, 1) {
+		return
+	}
+	for _, b := range r.buckets {
+		b.Refund(r.tokens)
+	}
+}
+
+// Wait blocks until the reserved tokens are available.
+// If ctx is done before that, or its deadline comes
+// earlier, the reservation is cancelled and Wait
+// returns the error of ctx.
+func (r *Reservation) Wait(ctx context.Context) error {
+	if !r.ok {
+		return ErrCapacityExceeded
+	}
+	if err := ctx.Err(); err != nil {
+		r.Cancel()
+		return err
+	}
+	if d := r.Delay(); d > 0 {
+		if err := sleepContext(ctx, r.clock, d); err != nil {
+			r.Cancel()
+			return err
+		}
+	}
+	atomic.StoreUint32(&r.done, 1)
+	return nil
+}
@@ -0,0 +1,136 @@
+package throttle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sitano/throttle"
+	"github.com/sitano/throttle/throttletest"
+)
+
+func TestBucket_Reserve(t *testing.T) {
+	t.Run("unlimited bucket is always ready", func(t *testing.T) {
+		b := throttle.NewBucket(0)
+		r := b.Reserve(100)
+		assertTrue(t, r.OK())
+		assertEqDuration(t, r.Delay(), 0)
+		assertNoErr(t, r.Wait(context.Background()))
+	})
+
+	t.Run("more than capacity is not ok", func(t *testing.T) {
+		b := throttle.NewBucket(10)
+		r := b.Reserve(11)
+		assertTrue(t, !r.OK())
+		assertErr(t, r.Wait(context.Background()), throttle.ErrCapacityExceeded)
+		assertEqU64(t, b.Fill(), 0)
+	})
+
+	t.Run("estimates delay", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+
+		r1 := b.Reserve(10)
+		assertTrue(t, r1.OK())
+		assertEqDuration(t, r1.Delay(), 0)
+
+		r2 := b.Reserve(5)
+		assertEqDuration(t, r2.Delay(), 500*time.Millisecond)
+		r3 := b.Reserve(10)
+		assertEqDuration(t, r3.Delay(), 1500*time.Millisecond)
+		assertEqU64(t, b.Fill(), 25)
+
+		c.Advance(500 * time.Millisecond)
+		assertEqDuration(t, r2.Delay(), 0)
+		assertEqDuration(t, r3.Delay(), time.Second)
+	})
+
+	t.Run("cancel gives tokens back", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+
+		b.Reserve(10)
+		r := b.Reserve(5)
+		r.Cancel()
+		assertEqU64(t, b.Fill(), 10)
+		r.Cancel()
+		assertEqU64(t, b.Fill(), 10, "cancel twice")
+
+		assertEqDuration(t, b.Reserve(5).Delay(), 500*time.Millisecond)
+	})
+
+	t.Run("wait sleeps for delay", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+
+		b.Reserve(10)
+		r := b.Reserve(5)
+
+		done := make(chan error)
+		go func() {
+			done <- r.Wait(context.Background())
+		}()
+
+		c.BlockUntil(1)
+		c.Advance(500 * time.Millisecond)
+		select {
+		case err := <-done:
+			assertNoErr(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("waiter was not woken")
+		}
+
+		r.Cancel()
+		assertEqU64(t, b.Fill(), 15, "cancel after wait")
+	})
+
+	t.Run("abandoned wait cancels", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		b := throttle.NewBucket(10)
+		b.SetClock(c)
+
+		b.Reserve(10)
+		r := b.Reserve(5)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assertErr(t, r.Wait(ctx), context.Canceled)
+		assertEqU64(t, b.Fill(), 10)
+	})
+}
+
+func TestHierarchy_Reserve(t *testing.T) {
+	t.Run("covers leaf and root", func(t *testing.T) {
+		c := throttletest.NewClock(time.Unix(1000, 0))
+		root := throttle.NewBucket(20)
+		root.SetClock(c)
+		h := throttle.NewHierarchy(root)
+		h.SetClock(c)
+		h.SetCapacity(10)
+
+		assertEqU64(t, root.Consume(20), 20)
+
+		r := h.Reserve(5)
+		assertTrue(t, r.OK())
+		assertEqDuration(t, r.Delay(), 250*time.Millisecond)
+		assertEqU64(t, h.Leaf().Fill(), 5)
+		assertEqU64(t, root.Fill(), 25)
+
+		r.Cancel()
+		assertEqU64(t, h.Leaf().Fill(), 0)
+		assertEqU64(t, root.Fill(), 20)
+	})
+
+	t.Run("more than root capacity is not ok", func(t *testing.T) {
+		root := throttle.NewBucket(20)
+		h := throttle.NewHierarchy(root)
+		h.SetCapacity(100)
+
+		assertTrue(t, !h.Reserve(30).OK())
+		assertEqU64(t, h.Leaf().Fill(), 0)
+		assertEqU64(t, root.Fill(), 0)
+	})
+}
@@ -0,0 +1,178 @@
+package throttle
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// source is the buckets shared by the connections
+// from the same remote address or network.
+type source struct {
+	key string
+
+	rb Bucket
+	wb Bucket
+	// accept rate
+	ab Bucket
+
+	// number of holders, guarded by Listener.mu
+	refs int
+	// number of live connections, guarded by Listener.mu
+	conns int
+	// conns over the source limits waiting to be admitted
+	// in delay mode, guarded by Listener.mu
+	pending []net.Conn
+	// last time the source had connections in ns,
+	// guarded by Listener.mu
+	seen int64
+}
+
+// DefaultSourceIdleTimeout is the time after which sources
+// without connections are evicted by Listener by default.
+const DefaultSourceIdleTimeout = time.Minute
+
+// sourceKey returns the remote IP of the address masked by
+// the source prefix length.
+func (l *Listener) sourceKey(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return addr.String()
+		}
+		if ip = net.ParseIP(host); ip == nil {
+			return host
+		}
+	}
+
+	var prefix, bits = int(atomic.LoadInt64(&l.srcPrefix6)), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		prefix, bits = int(atomic.LoadInt64(&l.srcPrefix4)), 32
+	}
+	if prefix <= 0 || prefix > bits {
+		prefix = bits
+	}
+
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}).String()
+}
+
+// acquire returns the buckets of the source and holds
+// them until release.
+func (l *Listener) acquire(key string) *source {
+	var now = l.rb.Clock().Now().UnixNano()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.evict(now)
+
+	src, ok := l.sources[key]
+	if !ok {
+		src = &source{key: key}
+		src.rb.SetParent(&l.rb)
+		src.wb.SetParent(&l.wb)
+		src.rb.SetClock(l.rb.Clock())
+		src.wb.SetClock(l.wb.Clock())
+		src.rb.SetCapacity(atomic.LoadUint64(&l.srcRead))
+		src.wb.SetCapacity(atomic.LoadUint64(&l.srcWrite))
+		src.ab.SetClock(l.ab.Clock())
+		src.ab.SetRate(atomic.LoadUint64(&l.srcAccept))
+		src.ab.SetBurst(atomic.LoadUint64(&l.srcAcceptBurst))
+		l.sources[key] = src
+	}
+	src.refs++
+	src.seen = now
+	return src
+}
+
+// release lets the source be evicted once it is idle
+// and has no connections.
+func (l *Listener) release(src *source) {
+	var now = l.rb.Clock().Now().UnixNano()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.releaseLocked(src, now)
+}
+
+func (l *Listener) releaseLocked(src *source, now int64) {
+	src.refs--
+	src.seen = now
+	if src.refs == 0 && atomic.LoadInt64(&l.srcIdle) <= 0 && l.sources[src.key] == src {
+		delete(l.sources, src.key)
+	}
+}
+
+// evict forgets the sources without connections idle for
+// longer than the idle timeout. It scans the sources at most
+// once per the timeout. It must be called under the lock.
+func (l *Listener) evict(now int64) {
+	var idle = atomic.LoadInt64(&l.srcIdle)
+	if idle <= 0 || now-l.evicted < idle {
+		return
+	}
+	l.evicted = now
+
+	for key, src := range l.sources {
+		if src.refs == 0 && now-src.seen >= idle {
+			delete(l.sources, key)
+		}
+	}
+}
+
+// Sources returns the number of the sources
+// the listener keeps buckets for.
+func (l *Listener) Sources() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.sources)
+}
+
+// sourced reports whether connections are grouped by sources.
+func (l *Listener) sourced() bool {
+	return atomic.LoadUint64(&l.srcRead) > 0 || atomic.LoadUint64(&l.srcWrite) > 0 ||
+		atomic.LoadUint64(&l.srcAccept) > 0 || atomic.LoadInt64(&l.srcMaxConns) > 0
+}
+
+// SetSourceCapacity sets both the read and the write capacity
+// shared by the connections from the same source. It applies
+// to new sources. The capacity of 0 in both directions turns
+// source buckets off.
+func (l *Listener) SetSourceCapacity(capacity uint64) {
+	l.SetSourceReadCapacity(capacity)
+	l.SetSourceWriteCapacity(capacity)
+}
+
+func (l *Listener) SetSourceReadCapacity(capacity uint64) {
+	atomic.StoreUint64(&l.srcRead, capacity)
+}
+
+func (l *Listener) SetSourceWriteCapacity(capacity uint64) {
+	atomic.StoreUint64(&l.srcWrite, capacity)
+}
+
+// SetSourcePrefix sets the prefix length of the remote IPv4 and
+// IPv6 addresses that make a source, e.g. 24 and 64 for subnets.
+// Source bandwidth and accept limits apply per source.
+// The prefix of 0 means the whole address, which is the default.
+func (l *Listener) SetSourcePrefix(ipv4, ipv6 int) {
+	atomic.StoreInt64(&l.srcPrefix4, int64(ipv4))
+	atomic.StoreInt64(&l.srcPrefix6, int64(ipv6))
+}
+
+// SetSourceIdleTimeout sets the time after which the sources
+// without connections are forgotten. The timeout of 0 forgets
+// them with the last connection.
+func (l *Listener) SetSourceIdleTimeout(d time.Duration) {
+	atomic.StoreInt64(&l.srcIdle, int64(d))
+}
@@ -0,0 +1,83 @@
+package throttle
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListener_SourceKey(t *testing.T) {
+	l := WrapListener(nil)
+
+	for _, tt := range []struct {
+		prefix4, prefix6 int
+		addr             net.Addr
+		key              string
+	}{
+		{0, 0, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 80}, "10.1.2.3/32"},
+		{24, 64, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 80}, "10.1.2.0/24"},
+		{0, 0, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}, "2001:db8::1/128"},
+		{24, 64, &net.TCPAddr{IP: net.ParseIP("2001:db8:0:1:2::1"), Port: 80}, "2001:db8:0:1::/64"},
+		{24, 64, &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, "/tmp/sock"},
+	} {
+		l.SetSourcePrefix(tt.prefix4, tt.prefix6)
+		if key := l.sourceKey(tt.addr); key != tt.key {
+			t.Error("source key of", tt.addr, "is", key, "!=", tt.key)
+		}
+	}
+}
+
+func TestListener_Source(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	wrap := WrapListener(ln)
+	defer wrap.Close()
+	wrap.SetCapacity(100)
+	wrap.SetSourceCapacity(50)
+	wrap.SetConnCapacity(10)
+	wrap.SetSourceIdleTimeout(0)
+
+	accept := func() *Conn {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("net.Dial:", err)
+		}
+		defer client.Close()
+
+		conn, err := wrap.Accept()
+		if err != nil {
+			t.Fatal("accept:", err)
+		}
+		return conn.(*Conn)
+	}
+
+	conn1, conn2 := accept(), accept()
+	assertEqU64(t, uint64(wrap.Sources()), 1)
+
+	src := conn1.ReadHierarchy().Root()
+	assertTrue(t, src == conn2.ReadHierarchy().Root())
+	assertTrue(t, src.Parent() == wrap.ReadBucket())
+	assertTrue(t, conn1.WriteHierarchy().Root().Parent() == wrap.WriteBucket())
+	assertEqU64(t, src.Capacity(), 50)
+	assertEqU64(t, conn1.ReadHierarchy().Leaf().Capacity(), 10)
+
+	assertNoErr(t, conn1.Close())
+	assertEqU64(t, uint64(wrap.Sources()), 1)
+	assertNoErr(t, conn2.Close())
+	assertEqU64(t, uint64(wrap.Sources()), 0)
+
+	t.Run("idle sources are evicted", func(t *testing.T) {
+		wrap.SetSourceIdleTimeout(50 * time.Millisecond)
+
+		assertNoErr(t, accept().Close())
+		assertEqU64(t, uint64(wrap.Sources()), 1)
+
+		time.Sleep(100 * time.Millisecond)
+		conn := accept()
+		defer conn.Close()
+		assertTrue(t, conn.ReadHierarchy().Root() != src)
+		assertEqU64(t, uint64(wrap.Sources()), 1)
+	})
+}
@@ -0,0 +1,153 @@
+package throttle
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the counters of a bucket or a hierarchy.
+type Stats struct {
+	// Consumed is the number of tokens given to consumers.
+	Consumed uint64
+	// Refunded is the number of tokens given back.
+	Refunded uint64
+	// Refused is the number of tokens requested but not given:
+	// not available to TryConsume, TryConsumeUpTo and Reserve or
+	// requested by consumers which gave up waiting.
+	Refused uint64
+	// Waits is the number of consumes which waited for the tokens.
+	Waits uint64
+	// Waited is the total time consumers waited for the tokens.
+	Waited time.Duration
+}
+
+// counters are updated atomically while traffic is flowing.
+type counters struct {
+	consumed uint64
+	refunded uint64
+	refused  uint64
+	waits    uint64
+	waited   uint64 // ns
+}
+
+// wait accounts the wait since start if the consumer has
+// blocked and returns its duration.
+func (c *counters) wait(blocked bool, start time.Time, clock Clock) time.Duration {
+	if !blocked {
+		return 0
+	}
+	var d = clock.Now().Sub(start)
+	atomic.AddUint64(&c.waits, 1)
+	atomic.AddUint64(&c.waited, uint64(d))
+	return d
+}
+
+// consume accounts tokens given after waiting for them.
+func (c *counters) consume(tokens uint64, waited time.Duration) {
+	atomic.AddUint64(&c.consumed, tokens)
+	if waited > 0 {
+		atomic.AddUint64(&c.waits, 1)
+		atomic.AddUint64(&c.waited, uint64(waited))
+	}
+}
+
+// refuse accounts tokens not given after waiting for them.
+func (c *counters) refuse(tokens uint64, waited time.Duration) {
+	atomic.AddUint64(&c.refused, tokens)
+	if waited > 0 {
+		atomic.AddUint64(&c.waits, 1)
+		atomic.AddUint64(&c.waited, uint64(waited))
+	}
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		Consumed: atomic.LoadUint64(&c.consumed),
+		Refunded: atomic.LoadUint64(&c.refunded),
+		Refused:  atomic.LoadUint64(&c.refused),
+		Waits:    atomic.LoadUint64(&c.waits),
+		Waited:   time.Duration(atomic.LoadUint64(&c.waited)),
+	}
+}
+
+// Stats returns the counters of the bucket. Consumers of
+// a hierarchy are accounted at every bucket of it.
+func (b *Bucket) Stats() Stats {
+	return b.stats.snapshot()
+}
+
+// Stats returns the counters of the consumers of the hierarchy.
+// A wait at several buckets of the hierarchy is a single wait.
+func (h *Hierarchy) Stats() Stats {
+	return h.stats.snapshot()
+}
+
+// ConnStats is a snapshot of the counters of a conn.
+type ConnStats struct {
+	// Read and Written are the number of bytes
+	// transferred by the conn.
+	Read    uint64
+	Written uint64
+	// Waits is the number of reads and writes
+	// which waited for the bandwidth.
+	Waits uint64
+	// Waited is the total time reads and writes
+	// waited for the bandwidth.
+	Waited time.Duration
+	// Refused is the number of bytes of the bandwidth
+	// reads and writes gave up waiting for.
+	Refused uint64
+}
+
+func (s *ConnStats) add(o ConnStats) {
+	s.Read += o.Read
+	s.Written += o.Written
+	s.Waits += o.Waits
+	s.Waited += o.Waited
+	s.Refused += o.Refused
+}
+
+// Stats returns the counters of the conn.
+func (c *Conn) Stats() ConnStats {
+	var r, w = c.r.Stats(), c.w.Stats()
+	return ConnStats{
+		Read:    atomic.LoadUint64(&c.read),
+		Written: atomic.LoadUint64(&c.written),
+		Waits:   r.Waits + w.Waits,
+		Waited:  r.Waited + w.Waited,
+		Refused: r.Refused + w.Refused,
+	}
+}
+
+// ListenerStats is a snapshot of the counters of a listener.
+type ListenerStats struct {
+	// Accepted is the number of connections accepted.
+	Accepted uint64
+	// Rejected is the number of connections rejected
+	// over the accept limits.
+	Rejected uint64
+	// Conns is the number of live connections.
+	Conns int
+	// ConnStats are the counters of all the connections
+	// accepted by the listener, live and closed.
+	ConnStats
+}
+
+// Stats returns the counters of the listener. The counters
+// of the server class are available with the Stats of
+// ReadBucket and WriteBucket.
+func (l *Listener) Stats() ListenerStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var s = ListenerStats{
+		Accepted:  l.accepted,
+		Rejected:  l.rejected,
+		Conns:     l.conns,
+		ConnStats: l.closedStats,
+	}
+	for c := range l.registry {
+		s.ConnStats.add(c.Stats())
+	}
+	return s
+}
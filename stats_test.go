@@ -0,0 +1,184 @@
+package throttle_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sitano/throttle"
+	"github.com/sitano/throttle/throttletest"
+)
+
+func assertStats(t *testing.T, s, expected throttle.Stats) {
+	if s != expected {
+		t.Errorf("stats %+v != %+v", s, expected)
+	}
+}
+
+func TestBucket_Stats(t *testing.T) {
+	c := throttletest.NewClock(time.Unix(1000, 0))
+	b := throttle.NewBucket(10)
+	b.SetClock(c)
+
+	assertEqU64(t, b.Consume(10), 10)
+	assertStats(t, b.Stats(), throttle.Stats{Consumed: 10})
+
+	done := make(chan uint64)
+	go func() {
+		done <- b.Consume(5)
+	}()
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	assertEqU64(t, <-done, 5)
+	assertStats(t, b.Stats(), throttle.Stats{Consumed: 15, Waits: 1, Waited: time.Second})
+
+	assertTrue(t, !b.TryConsume(10))
+	assertEqU64(t, b.TryConsumeUpTo(10), 5)
+	b.Refund(3)
+	assertStats(t, b.Stats(), throttle.Stats{Consumed: 20, Refunded: 3, Refused: 15, Waits: 1, Waited: time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := b.ConsumeContext(ctx, 10)
+		errs <- err
+	}()
+	c.BlockUntil(1)
+	c.Advance(100 * time.Millisecond)
+	cancel()
+	assertErr(t, <-errs, context.Canceled)
+	assertStats(t, b.Stats(), throttle.Stats{
+		Consumed: 20, Refunded: 3, Refused: 25, Waits: 2, Waited: time.Second + 100*time.Millisecond,
+	})
+}
+
+func TestHierarchy_Stats(t *testing.T) {
+	c := throttletest.NewClock(time.Unix(1000, 0))
+	root := throttle.NewBucket(10)
+	root.SetClock(c)
+	root.SetUnitDivisor(1, 1)
+	assertEqU64(t, root.Consume(10), 10)
+
+	h := throttle.NewHierarchy(root)
+	h.SetClock(c)
+	h.SetCapacity(100)
+
+	done := make(chan uint64)
+	go func() {
+		done <- h.Consume(10)
+	}()
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	assertEqU64(t, <-done, 10)
+
+	assertStats(t, h.Stats(), throttle.Stats{Consumed: 10, Waits: 1, Waited: time.Second})
+	assertStats(t, h.Leaf().Stats(), throttle.Stats{Consumed: 10})
+	assertStats(t, root.Stats(), throttle.Stats{Consumed: 20, Waits: 1, Waited: time.Second})
+
+	assertTrue(t, !h.TryConsume(10))
+	h.Refund(5)
+	assertStats(t, h.Stats(), throttle.Stats{Consumed: 10, Refunded: 5, Refused: 10, Waits: 1, Waited: time.Second})
+}
+
+func TestConn_Stats(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	c := throttletest.NewClock(time.Unix(1000, 0))
+	conn := throttle.WrapConn(c1)
+	conn.SetClock(c)
+	conn.SetWriteCapacity(10)
+	conn.Reset()
+
+	go func() {
+		_, _ = io.CopyN(ioutil.Discard, c2, 30)
+		_, _ = c2.Write([]byte("hello"))
+	}()
+
+	done := make(chan int)
+	go func() {
+		n, err := conn.Write(make([]byte, 30))
+		assertNoErr(t, err)
+		done <- n
+	}()
+	for i := 0; i < 2; i++ {
+		c.BlockUntil(1)
+		c.Advance(time.Second)
+	}
+	assertEqU64(t, uint64(<-done), 30)
+
+	n, err := conn.Read(make([]byte, 10))
+	assertNoErr(t, err)
+	assertEqU64(t, uint64(n), 5)
+
+	s := conn.Stats()
+	if s != (throttle.ConnStats{Read: 5, Written: 30, Waits: 2, Waited: 2 * time.Second}) {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestListener_Stats(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	wrap := throttle.WrapListener(ln)
+	defer wrap.Close()
+	wrap.SetMaxConns(1)
+	wrap.SetReject(true)
+
+	client1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("net.Dial:", err)
+	}
+	defer client1.Close()
+	conn, err := wrap.Accept()
+	if err != nil {
+		t.Fatal("accept:", err)
+	}
+
+	// rejected while the first one is live
+	client2, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("net.Dial:", err)
+	}
+	defer client2.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := wrap.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	_, err = ioutil.ReadAll(client2)
+	assertNoErr(t, err)
+
+	_, err = conn.Write([]byte("hello"))
+	assertNoErr(t, err)
+	_, err = io.ReadFull(client1, make([]byte, 5))
+	assertNoErr(t, err)
+
+	s := wrap.Stats()
+	assertEqU64(t, s.Accepted, 1)
+	assertEqU64(t, s.Rejected, 1)
+	assertEqU64(t, uint64(s.Conns), 1)
+	assertEqU64(t, s.Written, 5)
+
+	// counters of closed connections are kept
+	assertNoErr(t, conn.Close())
+	s = wrap.Stats()
+	assertEqU64(t, uint64(s.Conns), 0)
+	assertEqU64(t, s.Written, 5)
+
+	client3, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("net.Dial:", err)
+	}
+	defer client3.Close()
+	assertNoErr(t, (<-accepted).Close())
+	assertEqU64(t, wrap.Stats().Accepted, 2)
+}
@@ -0,0 +1,149 @@
+// Package throttletest provides utilities for testing code
+// which uses throttling.
+package throttletest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sitano/throttle"
+)
+
+// Clock is a manual throttle.Clock. Time stands still until
+// it is moved forward with Advance or Set, which fire the due
+// timers in order.
+type Clock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*Timer
+}
+
+var _ throttle.Clock = (*Clock)(nil)
+
+// Timer is a throttle.Timer of the manual Clock.
+type Timer struct {
+	c    *Clock
+	ch   chan time.Time
+	when time.Time
+}
+
+var _ throttle.Timer = (*Timer)(nil)
+
+// NewClock returns a manual clock set to now.
+func NewClock(now time.Time) *Clock {
+	c := &Clock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep blocks until the clock is advanced by d.
+func (c *Clock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *Clock) NewTimer(d time.Duration) throttle.Timer {
+	t := &Timer{c: c, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to now and fires all timers
+// which are due by then. Time never goes backwards.
+func (c *Clock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Before(c.now) {
+		return
+	}
+
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].when.Before(c.timers[j].when)
+	})
+
+	var i int
+	for ; i < len(c.timers) && !c.timers[i].when.After(now); i++ {
+		t := c.timers[i]
+		c.now = t.when
+		select {
+		case t.ch <- t.when:
+		default:
+		}
+	}
+	c.timers = append(c.timers[:0], c.timers[i:]...)
+	c.now = now
+	c.cond.Broadcast()
+}
+
+// Timers returns the number of pending timers.
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil blocks until there are at least n pending timers,
+// i.e. until n goroutines went to sleep on the clock.
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+func (t *Timer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *Timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.stop()
+}
+
+func (t *Timer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+
+	active := t.stop()
+	t.when = t.c.now.Add(d)
+	if d <= 0 {
+		select {
+		case t.ch <- t.when:
+		default:
+		}
+		return active
+	}
+	t.c.timers = append(t.c.timers, t)
+	t.c.cond.Broadcast()
+	return active
+}
+
+func (t *Timer) stop() bool {
+	for i, x := range t.c.timers {
+		if x == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			t.c.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
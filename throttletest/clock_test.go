@@ -0,0 +1,75 @@
+package throttletest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	t.Run("time stands still", func(t *testing.T) {
+		c := NewClock(start)
+		if !c.Now().Equal(start) {
+			t.Error("now:", c.Now(), "!=", start)
+		}
+		c.Advance(time.Second)
+		if !c.Now().Equal(start.Add(time.Second)) {
+			t.Error("now:", c.Now(), "!=", start.Add(time.Second))
+		}
+	})
+
+	t.Run("fires due timers only", func(t *testing.T) {
+		c := NewClock(start)
+		t1 := c.NewTimer(time.Second)
+		t2 := c.NewTimer(2 * time.Second)
+
+		c.Advance(time.Second)
+		select {
+		case at := <-t1.C():
+			if !at.Equal(start.Add(time.Second)) {
+				t.Error("fired at:", at)
+			}
+		default:
+			t.Error("timer 1 did not fire")
+		}
+		select {
+		case <-t2.C():
+			t.Error("timer 2 fired too early")
+		default:
+		}
+		if c.Timers() != 1 {
+			t.Error("timers:", c.Timers(), "!= 1")
+		}
+	})
+
+	t.Run("stopped timer does not fire", func(t *testing.T) {
+		c := NewClock(start)
+		tm := c.NewTimer(time.Second)
+		if !tm.Stop() {
+			t.Error("stop of active timer returned false")
+		}
+		c.Advance(time.Second)
+		select {
+		case <-tm.C():
+			t.Error("stopped timer fired")
+		default:
+		}
+	})
+
+	t.Run("wakes sleepers", func(t *testing.T) {
+		c := NewClock(start)
+		done := make(chan struct{})
+		go func() {
+			c.Sleep(time.Second)
+			close(done)
+		}()
+		c.BlockUntil(1)
+		c.Advance(time.Second)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("sleeper was not woken")
+		}
+	})
+}